@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+type rgb struct{ r, g, b float64 }
+
+// palettes are the gradients available for heat coloring, from coldest to hottest.
+var palettes = map[string][]rgb{
+	// ColorBrewer's sequential Reds and Blues.
+	"red":  {{255, 245, 240}, {252, 187, 161}, {251, 106, 74}, {203, 24, 29}, {103, 0, 13}},
+	"blue": {{247, 251, 255}, {198, 219, 239}, {107, 174, 214}, {33, 113, 181}, {8, 48, 107}},
+	// Viridis (reversed so that cold is light), which is perceptually uniform and colorblind-safe.
+	"viridis": {{253, 231, 37}, {94, 201, 98}, {33, 145, 140}, {59, 82, 139}, {68, 1, 84}},
+}
+
+// heatColor returns the fill color for a node with the given count, relative to max, as an RGB hex string.
+// It also returns a font color that is legible on that fill.
+func heatColor(count, max int, palette string) (fill, font string) {
+	stops := palettes[palette]
+	f := 0.0
+	if max > 0 {
+		f = math.Min(float64(count)/float64(max), 1)
+	}
+	pos := f * float64(len(stops)-1)
+	i := int(pos)
+	if i >= len(stops)-1 {
+		i = len(stops) - 2
+	}
+	t := pos - float64(i)
+	c1, c2 := stops[i], stops[i+1]
+	c := rgb{
+		c1.r + t*(c2.r-c1.r),
+		c1.g + t*(c2.g-c1.g),
+		c1.b + t*(c2.b-c1.b),
+	}
+	return c.colors()
+}
+
+// colors returns c as an RGB hex string, along with a font color that is legible on it.
+func (c rgb) colors() (fill, font string) {
+	font = "black"
+	// Relative luminance, roughly.
+	if 0.299*c.r+0.587*c.g+0.114*c.b < 128 {
+		font = "white"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", int(c.r+0.5), int(c.g+0.5), int(c.b+0.5)), font
+}
+
+// lineColors assigns fill and font colors to the nodes of methods that appear at more than one line, for
+// -color-by line. Each such method gets its own hue, derived from its name so that it is the same from run to
+// run, and each of its lines a shade of that hue: the more samples (cumulatively) at the line relative to the
+// method's hottest line, the darker the shade.
+func lineColors(nodes []*Node) map[*Node][2]string {
+	byMethod := make(map[string][]*Node)
+	for _, node := range nodes {
+		if !node.Synthetic {
+			byMethod[node.Name] = append(byMethod[node.Name], node)
+		}
+	}
+	colors := make(map[*Node][2]string)
+	for name, lines := range byMethod {
+		if len(lines) < 2 {
+			continue
+		}
+		max := 0
+		for _, node := range lines {
+			if node.CumulativeCount > max {
+				max = node.CumulativeCount
+			}
+		}
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		hue := float64(h.Sum32() % 360)
+		for _, node := range lines {
+			f := 0.0
+			if max > 0 {
+				f = float64(node.CumulativeCount) / float64(max)
+			}
+			fill, font := hsv(hue, 0.15+0.7*f, 1-0.45*f).colors()
+			colors[node] = [2]string{fill, font}
+		}
+	}
+	return colors
+}
+
+// hsv converts a color given by hue (in degrees), saturation, and value (both in [0, 1]) to RGB.
+func hsv(h, s, v float64) rgb {
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return rgb{255 * (r + m), 255 * (g + m), 255 * (b + m)}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// WriteCSV writes one row for each of nodes to w, with the call site and its self and cumulative sample
+// counts and percentages, in descending order of cumulative count. The percentages are of total, the sample
+// count of the profile before any filtering.
+func WriteCSV(w io.Writer, nodes []*Node, total int) error {
+	percent := func(n int) string {
+		if total == 0 {
+			return "0"
+		}
+		return fmt.Sprintf("%.2f", 100*float64(n)/float64(total))
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "file", "line", "self", "self_percent", "cumulative", "cumulative_percent"})
+	for _, node := range TopCumulative(nodes, len(nodes)) {
+		line := ""
+		if node.LineNumber > 0 {
+			line = strconv.Itoa(node.LineNumber)
+		}
+		cw.Write([]string{
+			node.Name + node.Signature,
+			node.Filename,
+			line,
+			strconv.Itoa(node.Count),
+			percent(node.Count),
+			strconv.Itoa(node.CumulativeCount),
+			percent(node.CumulativeCount),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
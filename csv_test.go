@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteCSVPercentages(t *testing.T) {
+	traces := testTraces("6 b a", "3 c a", "1 d a")
+	opts := testOptions()
+	opts.Threshold = 0.2
+	nodes := BuildNodes(traces, opts)
+	var buf strings.Builder
+	if err := WriteCSV(&buf, nodes, CountSum(traces)); err != nil {
+		t.Fatal(err)
+	}
+	// d falls below the threshold, but b's and c's percentages are still of all 10 samples.
+	want := `name,file,line,self,self_percent,cumulative,cumulative_percent
+a,a.java,1,0,0.00,10,100.00
+b,b.java,1,6,60.00,6,60.00
+c,c.java,1,3,30.00,3,30.00
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
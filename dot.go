@@ -1,23 +1,33 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"math"
-	"strconv"
+	"sort"
+	"strings"
 	"text/template"
+	"unicode"
+	"unicode/utf8"
 )
 
 type DotNode struct {
-	Num   int
-	Label string
-	Count int
+	Num       int
+	Label     string
+	Count     int
+	Synthetic bool   // drawn in gray
+	Tooltip   string // full call site, if the label is abbreviated
+
+	FillColor string // for -color-by; empty for none
+	FontColor string
 }
 
 type DotEdge struct {
 	Node1, Node2 int // DotNode.Num
 	Label        string
-	Weight int
+	Weight       int
+	Dashed       bool
 }
 
 type DotGraph struct {
@@ -25,30 +35,68 @@ type DotGraph struct {
 	MaxCount int
 	Nodes    []*DotNode
 	Edges    []*DotEdge
+
+	TopSelf []string // for -rich-legend, the record-escaped labels of the hottest nodes
+	Note    string   // caveat shown in the legend, if any
 }
 
-func WriteDotFormat(w io.Writer, filename string, nodes []*Node) error {
+// richLegendRows is the number of nodes listed in the legend with -rich-legend.
+const richLegendRows = 5
+
+// BuildDotGraph lays out nodes as a DotGraph, ready to be written.
+func BuildDotGraph(nodes []*Node, opts Options) *DotGraph {
 	totalCount := 0
 	for _, node := range nodes {
 		totalCount += node.Count
 	}
 
+	// Heat colors are relative to the whole profile or, with -color-base focus, to the hottest node shown.
+	heatMax := opts.ProfileTotal
+	if opts.ColorBase == "focus" || heatMax == 0 {
+		heatMax = 0
+		for _, node := range nodes {
+			if node.CumulativeCount > heatMax {
+				heatMax = node.CumulativeCount
+			}
+		}
+	}
+
+	var lineFills map[*Node][2]string
+	if opts.ColorBy == "line" {
+		lineFills = lineColors(nodes)
+	}
+
 	nodeToDotNode := make(map[*Node]*DotNode)
 	var dotNodes []*DotNode
 	num := 1
 	for _, node := range nodes {
-		lineNumber := "???"
-		if node.LineNumber > 0 {
-			lineNumber = strconv.Itoa(node.LineNumber)
+		if opts.SelfOnly && node.Count == 0 && !opts.IncludeEmptyCounts {
+			continue
 		}
 		selfFraction := float64(node.Count) / float64(totalCount)
-		line := fmt.Sprintf(
-			"%d (%0.1f%%) %s[%s:%s]", node.Count, 100*selfFraction, node.Name, node.Filename, lineNumber,
-		)
+		site := node.CallSite
+		if opts.AbbreviatePackages && !site.Synthetic {
+			abbreviated := *site
+			abbreviated.Name = abbreviatePackages(site.Name)
+			site = &abbreviated
+		}
+		line := fmt.Sprintf("%d (%0.1f%%) %s", node.Count, 100*selfFraction, site)
 		dotNode := &DotNode{
-			Num:   num,
-			Label: line,
-			Count: node.Count,
+			Num:       num,
+			Label:     escapeLabel(line, opts.LabelEncoding),
+			Count:     node.Count,
+			Synthetic: node.Synthetic,
+		}
+		if site != node.CallSite {
+			dotNode.Tooltip = escapeLabel(node.CallSite.String(), opts.LabelEncoding)
+		}
+		switch opts.ColorBy {
+		case "heat":
+			dotNode.FillColor, dotNode.FontColor = heatColor(node.CumulativeCount, heatMax, opts.Palette)
+		case "line":
+			if c, ok := lineFills[node]; ok {
+				dotNode.FillColor, dotNode.FontColor = c[0], c[1]
+			}
 		}
 		num++
 		nodeToDotNode[node] = dotNode
@@ -57,23 +105,130 @@ func WriteDotFormat(w io.Writer, filename string, nodes []*Node) error {
 
 	var edges []*DotEdge
 	for _, node := range nodes {
+		if opts.SelfOnly {
+			break
+		}
+		// A recursive call is not a call out of the node, so the caller's share leaves self-loops out.
+		outbound := 0
+		for child, weight := range node.EdgeWeights {
+			if child != node {
+				outbound += weight
+			}
+		}
 		for child, weight := range node.EdgeWeights {
+			if child == node && opts.NoSelfLoops {
+				// Mention the recursion in the label instead.
+				fraction := float64(weight) / float64(totalCount)
+				nodeToDotNode[node].Label += fmt.Sprintf(`\nrecursive: %d (%.1f%%)`, weight, 100*fraction)
+				continue
+			}
 			edge := &DotEdge{
-				Node1: nodeToDotNode[node].Num,
-				Node2: nodeToDotNode[child].Num,
-				Label: fmt.Sprintf("%d (%.1f%%)", weight, 100*float64(weight)/float64(totalCount)),
+				Node1:  nodeToDotNode[node].Num,
+				Node2:  nodeToDotNode[child].Num,
 				Weight: weight,
 			}
+			// For a pair of edges in opposite directions, -bidi-edges controls how the lighter one is drawn.
+			if reverse, ok := child.EdgeWeights[node]; ok && child != node && reverse > weight {
+				switch opts.BidiEdges {
+				case "heavier":
+					continue
+				case "dashed":
+					edge.Dashed = true
+				}
+			}
+			fraction := float64(weight) / float64(totalCount)
+			if fraction >= opts.EdgeMinLabel {
+				if opts.EdgeLabel == "rich" && child != node {
+					edge.Label = fmt.Sprintf("%d (%.1f%% of total, %.1f%% of caller)",
+						weight, 100*fraction, 100*float64(weight)/float64(outbound))
+				} else {
+					edge.Label = fmt.Sprintf("%d (%.1f%%)", weight, 100*fraction)
+				}
+			}
 			edges = append(edges, edge)
 		}
 	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Node1 != edges[j].Node1 {
+			return edges[i].Node1 < edges[j].Node1
+		}
+		return edges[i].Node2 < edges[j].Node2
+	})
 
-	graph := &DotGraph{
-		Filename: filename,
+	g := &DotGraph{
+		Filename: escapeLabel(opts.Filename, opts.LabelEncoding),
 		MaxCount: totalCount,
 		Nodes:    dotNodes,
 		Edges:    edges,
 	}
+	if opts.DepthDecay > 0 {
+		g.Note = fmt.Sprintf("EXPERIMENTAL: cumulative counts weighted by %g per level above the leaf", opts.DepthDecay)
+	}
+	if opts.RichLegend {
+		g.Filename = recordEscape(g.Filename)
+		for i, node := range TopLeaves(nodes, richLegendRows) {
+			if node.Count == 0 {
+				break
+			}
+			line := fmt.Sprintf("%d. %0.1f%% %s", i+1, 100*float64(node.Count)/float64(totalCount), node.CallSite)
+			g.TopSelf = append(g.TopSelf, recordEscape(escapeLabel(line, opts.LabelEncoding)))
+		}
+	}
+	return g
+}
+
+// recordEscape escapes the characters that are special in the labels of record-shaped DOT nodes.
+func recordEscape(s string) string {
+	return strings.NewReplacer("{", `\{`, "}", `\}`, "|", `\|`, "<", `\<`, ">", `\>`).Replace(s)
+}
+
+// dotEscape escapes s for use inside a double-quoted DOT string.
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// abbreviatePackages shortens all but the last package component of the qualified method name to their first
+// letters, so that "com.example.service.impl.FooServiceImpl.handle" becomes "c.e.s.impl.FooServiceImpl.handle".
+// The class is taken to be the first capitalized component (or, if there is none, the next-to-last one).
+func abbreviatePackages(name string) string {
+	parts := strings.Split(name, ".")
+	class := len(parts) - 2
+	for i, part := range parts {
+		if part != "" && unicode.IsUpper([]rune(part)[0]) {
+			class = i
+			break
+		}
+	}
+	for i := 0; i < class-1; i++ {
+		if r := []rune(parts[i]); len(r) > 1 {
+			parts[i] = string(r[0])
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// escapeLabel escapes s for use as a DOT label using the given encoding: "utf8" (or "") leaves non-ASCII
+// characters as they are, while "ascii" replaces them with numeric character references (such as "&#233;"),
+// which Graphviz decodes when rendering.
+func escapeLabel(s, encoding string) string {
+	s = dotEscape(s)
+	if encoding != "ascii" {
+		return s
+	}
+	var buf bytes.Buffer
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			buf.WriteRune(r)
+		} else {
+			fmt.Fprintf(&buf, "&#%d;", r)
+		}
+	}
+	return buf.String()
+}
+
+// Write writes g to w in the DOT language.
+func (g *DotGraph) Write(w io.Writer) error {
+	totalCount := g.MaxCount
 	// These mysterious sizing functions are copied from pprof's perl script.
 	fontSize := func(count int) float64 {
 		return 50*math.Sqrt(float64(count)/float64(totalCount)) + 8
@@ -98,22 +253,38 @@ func WriteDotFormat(w io.Writer, filename string, nodes []*Node) error {
 	}
 
 	dotTemplate, err := template.New("dot").Funcs(map[string]interface{}{
-		"fontSize": fontSize,
+		"fontSize":   fontSize,
 		"edgeWeight": edgeWeight,
-		"edgeWidth": edgeWidth,
+		"edgeWidth":  edgeWidth,
 	}).Parse(tmpl)
 	if err != nil {
 		return err
 	}
-	return dotTemplate.Execute(w, graph)
+	return dotTemplate.Execute(w, g)
+}
+
+// WriteDotFormat renders nodes as a DOT graph to w.
+func WriteDotFormat(w io.Writer, nodes []*Node, opts Options) error {
+	return BuildDotGraph(nodes, opts).Write(w)
+}
+
+// RenderDot renders nodes as a DOT graph and returns it as a string.
+func RenderDot(nodes []*Node, opts Options) (string, error) {
+	var buf bytes.Buffer
+	if err := WriteDotFormat(&buf, nodes, opts); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
 }
 
 var tmpl = `digraph "HProf output for {{.Filename}}" {
 node [width=0.375,height=0.25];
-Legend [shape=box,fontsize=24,shape=plaintext,label="{{.Filename}}:\lexamining {{.MaxCount}} samples"];
-{{range .Nodes}}N{{.Num}} [label="{{.Label}}",shape=box,fontsize={{fontSize .Count | printf "%0.2f"}}];
+{{if .TopSelf}}Legend [shape=record,fontsize=16,label="{ {{.Filename}}:\lexamining {{.MaxCount}} samples\l{{if .Note}}{{.Note}}\l{{end}}|top self samples:\l{{range .TopSelf}}{{.}}\l{{end}} }"];
+{{else}}Legend [shape=box,fontsize=24,shape=plaintext,label="{{.Filename}}:\lexamining {{.MaxCount}} samples{{if .Note}}\l{{.Note}}\l{{end}}"];
+{{end}}
+{{range .Nodes}}N{{.Num}} [label="{{.Label}}",{{if .Tooltip}}tooltip="{{.Tooltip}}",{{end}}shape=box,fontsize={{fontSize .Count | printf "%0.2f"}}{{if .Synthetic}},color=gray,fontcolor=gray{{end}}{{if .FillColor}},style=filled,fillcolor="{{.FillColor}}",fontcolor={{.FontColor}}{{end}}];
 {{end}}
-{{range .Edges}}N{{.Node1}} -> N{{.Node2}} [label="{{.Label}}", weight={{edgeWeight .Weight}}, style="setlinewidth({{edgeWidth .Weight | printf "%.3f"}})"];
+{{range .Edges}}N{{.Node1}} -> N{{.Node2}} [{{if .Label}}label="{{.Label}}", {{end}}weight={{edgeWeight .Weight}}, style="setlinewidth({{edgeWidth .Weight | printf "%.3f"}}){{if .Dashed}},dashed{{end}}"];
 {{end}}
 }
 `
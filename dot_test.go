@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+func TestBuildDotGraphRichLabels(t *testing.T) {
+	// b calls itself in the first trace, so it has a self-loop of weight 4 and an edge of weight 4 to c.
+	traces := testTraces("4 c b b a", "2 d b a", "1 b a")
+	opts := testOptions()
+	opts.EdgeLabel = "rich"
+	nodes := CreateNodes(traces, 0)
+	g := BuildDotGraph(nodes, opts)
+	labels := make(map[[2]string]string)
+	for _, edge := range g.Edges {
+		// Every node is drawn, so DotNode numbers follow the order of nodes from 1.
+		labels[[2]string{nodes[edge.Node1-1].Name, nodes[edge.Node2-1].Name}] = edge.Label
+	}
+	for _, tt := range []struct {
+		from, to, want string
+	}{
+		{"b", "c", "4 (57.1% of total, 66.7% of caller)"},
+		{"b", "d", "2 (28.6% of total, 33.3% of caller)"},
+		{"b", "b", "4 (57.1%)"},
+	} {
+		if got := labels[[2]string{tt.from, tt.to}]; got != tt.want {
+			t.Errorf("%s -> %s: got label %q; want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestBuildDotGraphIncludeEmptyCounts(t *testing.T) {
+	// b is only ever an interior frame, so it has no self samples.
+	traces := testTraces("5 c b a", "2 a")
+	nodes := CreateNodes(traces, 0)
+	opts := testOptions()
+	opts.SelfOnly = true
+	for _, tt := range []struct {
+		includeEmpty bool
+		want         int
+	}{
+		{false, 2},
+		{true, 3},
+	} {
+		opts.IncludeEmptyCounts = tt.includeEmpty
+		g := BuildDotGraph(nodes, opts)
+		if len(g.Nodes) != tt.want {
+			t.Errorf("-include-empty-counts=%t: got %d nodes; want %d", tt.includeEmpty, len(g.Nodes), tt.want)
+		}
+		if len(g.Edges) != 0 {
+			t.Errorf("-include-empty-counts=%t: got %d edges with -self-only; want none", tt.includeEmpty, len(g.Edges))
+		}
+	}
+}
+
+func TestAbbreviatePackages(t *testing.T) {
+	for _, tt := range []struct {
+		name, want string
+	}{
+		{"com.example.service.impl.FooServiceImpl.handle", "c.e.s.impl.FooServiceImpl.handle"},
+		{"java.lang.Thread.run", "j.lang.Thread.run"},
+		{"org.apache.Outer$Inner.run", "o.apache.Outer$Inner.run"},
+		{"über.paket.Klasse.m", "ü.paket.Klasse.m"},
+		{"com.example.lowercase.method", "c.example.lowercase.method"}, // no class name: the last package is kept
+		{"Main.main", "Main.main"},
+		{"main", "main"},
+	} {
+		if got := abbreviatePackages(tt.name); got != tt.want {
+			t.Errorf("abbreviatePackages(%q) = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	for _, tt := range []struct {
+		s, encoding, want string
+	}{
+		{"com.example.Foo.run", "utf8", "com.example.Foo.run"},
+		{`com.example.Foo.say"hi"`, "utf8", `com.example.Foo.say\"hi\"`},
+		{`C:\src\Foo.java`, "utf8", `C:\\src\\Foo.java`},
+		{`a\"b`, "utf8", `a\\\"b`},
+		// Labels are quoted strings rather than HTML-like labels, so angle brackets are left alone.
+		{"java.util.Map<K,V>.get", "utf8", "java.util.Map<K,V>.get"},
+		{"com.example.Foo.lambda$run$0", "utf8", "com.example.Foo.lambda$run$0"},
+		{"com.example.Foo$$Lambda$14/0x0000000800c02a00.apply", "", "com.example.Foo$$Lambda$14/0x0000000800c02a00.apply"},
+		{"com.example.Größe.<init>", "utf8", "com.example.Größe.<init>"},
+		{"com.example.Größe.<init>", "ascii", "com.example.Gr&#246;&#223;e.<init>"},
+		{`List<"ü">`, "ascii", `List<\"&#252;\">`},
+	} {
+		if got := escapeLabel(tt.s, tt.encoding); got != tt.want {
+			t.Errorf("escapeLabel(%q, %q) = %q; want %q", tt.s, tt.encoding, got, tt.want)
+		}
+	}
+}
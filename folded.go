@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// WriteFolded writes traces to w in the "folded" (collapsed stack) format read by FlameGraph's flamegraph.pl
+// and speedscope: one line per distinct stack, with the frames from the root to the leaf separated by
+// semicolons, followed by a space and the sample count. If withLines is set, each frame also gives its file
+// and line, as in -list-traces; otherwise frames are just method names, so that the samples of the lines of a
+// method are merged. Traces with the same folded stack are summed, and the lines are sorted by stack.
+func WriteFolded(w io.Writer, traces map[*Trace]bool, withLines bool) error {
+	// Sum the traces with equal stacks (see StackKey) first, so that each distinct stack is folded once.
+	byStack := make(map[string]*Trace)
+	stackCounts := make(map[string]int)
+	for trace := range traces {
+		key := StackKey(trace.Stack, withLines)
+		if _, ok := byStack[key]; !ok {
+			byStack[key] = trace
+		}
+		stackCounts[key] += trace.Count
+	}
+	counts := make(map[string]int)
+	frames := make([]string, 0, 64)
+	for key, trace := range byStack {
+		frames = frames[:0]
+		for i := len(trace.Stack) - 1; i >= 0; i-- {
+			site := trace.Stack[i]
+			frame := site.Name
+			if withLines {
+				frame = site.String()
+			}
+			// A semicolon would split the frame in two.
+			frames = append(frames, strings.Replace(frame, ";", ",", -1))
+		}
+		counts[strings.Join(frames, ";")] += stackCounts[key]
+	}
+	stacks := make([]string, 0, len(counts))
+	for stack := range counts {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	bw := bufio.NewWriter(w)
+	for _, stack := range stacks {
+		fmt.Fprintf(bw, "%s %d\n", stack, counts[stack])
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteFolded(t *testing.T) {
+	traces := testTraces("5 c b a", "2 c:2 b a", "3 b a")
+	for _, tt := range []struct {
+		withLines bool
+		want      string
+	}{
+		{false, "a;b 3\na;b;c 7\n"},
+		{true, "a[a.java:1];b[b.java:1] 3\na[a.java:1];b[b.java:1];c[c.java:1] 5\na[a.java:1];b[b.java:1];c[c.java:2] 2\n"},
+	} {
+		var buf strings.Builder
+		if err := WriteFolded(&buf, traces, tt.withLines); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tt.want {
+			t.Errorf("with lines: %t: got\n%s\nwant\n%s", tt.withLines, got, tt.want)
+		}
+	}
+}
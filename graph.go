@@ -0,0 +1,247 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Stats summarizes the structure of a graph of Nodes.
+type Stats struct {
+	Nodes    int
+	Edges    int
+	Roots    int // nodes with no inbound edges (other than self-loops)
+	Leaves   int // nodes with no outbound edges
+	MaxDepth int // number of nodes on the longest acyclic path from a root
+	Cyclic   bool
+}
+
+// GraphStats computes structural statistics for the graph formed by nodes. Only edges between members of
+// nodes are considered.
+func GraphStats(nodes []*Node) Stats {
+	s := Stats{Nodes: len(nodes)}
+	inGraph := make(map[*Node]bool)
+	for _, node := range nodes {
+		inGraph[node] = true
+	}
+	hasParent := make(map[*Node]bool)
+	for _, node := range nodes {
+		outbound := 0
+		for child := range node.EdgeWeights {
+			if !inGraph[child] {
+				continue
+			}
+			outbound++
+			if child != node {
+				hasParent[child] = true
+			}
+		}
+		s.Edges += outbound
+		if outbound == 0 {
+			s.Leaves++
+		}
+	}
+
+	const (
+		unvisited = iota
+		active
+		done
+	)
+	state := make(map[*Node]int)
+	depth := make(map[*Node]int) // longest path from the node to a leaf, in nodes
+	var visit func(node *Node) int
+	visit = func(node *Node) int {
+		switch state[node] {
+		case active:
+			s.Cyclic = true
+			return 0
+		case done:
+			return depth[node]
+		}
+		state[node] = active
+		d := 0
+		for child := range node.EdgeWeights {
+			if !inGraph[child] {
+				continue
+			}
+			if cd := visit(child); cd > d {
+				d = cd
+			}
+		}
+		state[node] = done
+		depth[node] = d + 1
+		return d + 1
+	}
+	for _, node := range nodes {
+		if hasParent[node] {
+			continue
+		}
+		s.Roots++
+		if d := visit(node); d > s.MaxDepth {
+			s.MaxDepth = d
+		}
+	}
+	// Visit anything unreachable from a root (i.e., nodes only on cycles).
+	for _, node := range nodes {
+		visit(node)
+	}
+	return s
+}
+
+// PruneEdges removes edges between nodes weighing less than min, except for a tree of edges that keeps the
+// graph connected: growing the tree from the roots along the heaviest edges first, each node keeps the inbound
+// edge by which it is first reached. (Nodes on cycles that no root reaches are reached from one of them.) So
+// every node with a parent retains a path toward a root, even when two nodes are each other's heaviest callers,
+// and the pruned graph remains a readable skeleton of the original. PruneEdges returns the number of edges
+// removed.
+func PruneEdges(nodes []*Node, min int) int {
+	inGraph := make(map[*Node]bool)
+	for _, node := range nodes {
+		inGraph[node] = true
+	}
+	hasParent := make(map[*Node]bool)
+	for _, node := range nodes {
+		for child := range node.EdgeWeights {
+			if inGraph[child] && child != node {
+				hasParent[child] = true
+			}
+		}
+	}
+
+	treeParent := make(map[*Node]*Node)
+	reached := make(map[*Node]bool)
+	var edges edgeHeap
+	reach := func(node *Node) {
+		reached[node] = true
+		for child, weight := range node.EdgeWeights {
+			if inGraph[child] && !reached[child] {
+				heap.Push(&edges, treeEdge{node, child, weight})
+			}
+		}
+	}
+	grow := func() {
+		for edges.Len() > 0 {
+			e := heap.Pop(&edges).(treeEdge)
+			if reached[e.child] {
+				continue
+			}
+			treeParent[e.child] = e.parent
+			reach(e.child)
+		}
+	}
+	for _, node := range nodes {
+		if !hasParent[node] {
+			reach(node)
+		}
+	}
+	grow()
+	for _, node := range nodes {
+		if !reached[node] {
+			reach(node)
+			grow()
+		}
+	}
+
+	removed := 0
+	for _, node := range nodes {
+		for child, weight := range node.EdgeWeights {
+			if weight < min && treeParent[child] != node {
+				delete(node.EdgeWeights, child)
+				removed++
+			}
+		}
+		if len(node.EdgeWeights) == 0 {
+			node.EdgeWeights = nil
+		}
+	}
+	return removed
+}
+
+// A treeEdge is a candidate edge for the tree grown by PruneEdges.
+type treeEdge struct {
+	parent, child *Node
+	weight        int
+}
+
+// An edgeHeap is a heap of treeEdges, heaviest first (and then by call site, for deterministic output).
+type edgeHeap []treeEdge
+
+func (h edgeHeap) Len() int { return len(h) }
+
+func (h edgeHeap) Less(i, j int) bool {
+	if h[i].weight != h[j].weight {
+		return h[i].weight > h[j].weight
+	}
+	if h[i].parent != h[j].parent {
+		return lessCallSite(h[i].parent.CallSite, h[j].parent.CallSite)
+	}
+	return lessCallSite(h[i].child.CallSite, h[j].child.CallSite)
+}
+
+func (h edgeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *edgeHeap) Push(x interface{}) { *h = append(*h, x.(treeEdge)) }
+
+func (h *edgeHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// DropLightEdges removes every edge with fewer than min samples and returns the number of edges removed.
+// Unlike PruneEdges, it may leave a node with no inbound edges.
+func DropLightEdges(nodes []*Node, min int) int {
+	removed := 0
+	for _, node := range nodes {
+		for child, weight := range node.EdgeWeights {
+			if weight < min {
+				delete(node.EdgeWeights, child)
+				removed++
+			}
+		}
+		if len(node.EdgeWeights) == 0 {
+			node.EdgeWeights = nil
+		}
+	}
+	return removed
+}
+
+// TopLeaves returns the (at most) n nodes with the most self samples, in descending order of self count and
+// then by call site.
+func TopLeaves(nodes []*Node, n int) []*Node {
+	return topNodes(nodes, n, func(node *Node) int { return node.Count })
+}
+
+// TopCumulative returns the (at most) n nodes with the most cumulative samples, in descending order of
+// cumulative count and then by call site.
+func TopCumulative(nodes []*Node, n int) []*Node {
+	return topNodes(nodes, n, func(node *Node) int { return node.CumulativeCount })
+}
+
+// topNodes returns the (at most) n nodes with the highest count, in descending order of count and then by
+// call site.
+func topNodes(nodes []*Node, n int, count func(*Node) int) []*Node {
+	sorted := append([]*Node(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		c1, c2 := count(sorted[i]), count(sorted[j])
+		if c1 != c2 {
+			return c1 > c2
+		}
+		return lessCallSite(sorted[i].CallSite, sorted[j].CallSite)
+	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted
+}
+
+// lessCallSite orders CallSites by name, then filename, then line number.
+func lessCallSite(s1, s2 *CallSite) bool {
+	if s1.Name != s2.Name {
+		return s1.Name < s2.Name
+	}
+	if s1.Filename != s2.Filename {
+		return s1.Filename < s2.Filename
+	}
+	return s1.LineNumber < s2.LineNumber
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGraphStats(t *testing.T) {
+	for _, tt := range []struct {
+		specs []string
+		want  Stats
+	}{
+		{
+			[]string{"3 c b a", "2 d b a", "1 e a"},
+			Stats{Nodes: 5, Edges: 4, Roots: 1, Leaves: 3, MaxDepth: 3},
+		},
+		{
+			// a and b call each other and c calls itself, so there are no roots and no leaves.
+			[]string{"4 c c b a b a"},
+			Stats{Nodes: 3, Edges: 4, Roots: 0, Leaves: 0, MaxDepth: 0, Cyclic: true},
+		},
+	} {
+		nodes := CreateNodes(testTraces(tt.specs...), 0)
+		if got := GraphStats(nodes); got != tt.want {
+			t.Errorf("%q: got %+v; want %+v", tt.specs, got, tt.want)
+		}
+	}
+}
+
+func TestPruneEdges(t *testing.T) {
+	traces := testTraces("10 b a", "1 c b a", "2 c a", "1 d b a")
+	nodes := CreateNodes(traces, 0)
+	if removed := PruneEdges(nodes, 5); removed != 1 {
+		t.Errorf("got %d edges removed; want 1", removed)
+	}
+	a, b, c, d := nodeByName(nodes, "a"), nodeByName(nodes, "b"), nodeByName(nodes, "c"), nodeByName(nodes, "d")
+	if _, ok := b.EdgeWeights[c]; ok {
+		t.Error("the light edge b -> c was kept, though c has a heavier caller")
+	}
+	// Every node remains reachable from the root.
+	reached := map[*Node]bool{a: true}
+	for queue := []*Node{a}; len(queue) > 0; queue = queue[1:] {
+		for child := range queue[0].EdgeWeights {
+			if !reached[child] {
+				reached[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	for _, node := range []*Node{b, c, d} {
+		if !reached[node] {
+			t.Errorf("%s is not reachable from a after pruning", node.Name)
+		}
+	}
+	if stats := GraphStats(nodes); stats.Roots != 1 {
+		t.Errorf("got %d roots after pruning; want 1", stats.Roots)
+	}
+}
+
+func TestTopNodesTies(t *testing.T) {
+	traces := testTraces("3 c", "3 b:2", "3 b:1", "5 a d", "3 e d")
+	nodes := CreateNodes(traces, 0)
+	sites := func(nodes []*Node) string {
+		var s []string
+		for _, node := range nodes {
+			s = append(s, node.CallSite.String())
+		}
+		return strings.Join(s, " ")
+	}
+	// Ties are broken by name, then line.
+	if got, want := sites(TopLeaves(nodes, 4)), "a[a.java:1] b[b.java:1] b[b.java:2] c[c.java:1]"; got != want {
+		t.Errorf("TopLeaves: got %s; want %s", got, want)
+	}
+	if got, want := sites(TopCumulative(nodes, 3)), "d[d.java:1] a[a.java:1] b[b.java:1]"; got != want {
+		t.Errorf("TopCumulative: got %s; want %s", got, want)
+	}
+}
+
+func TestPruneEdgesMutualRecursion(t *testing.T) {
+	// a and b call each other, and each is the other's heaviest caller.
+	traces := testTraces("5 a b a r", "5 b a b r")
+	nodes := CreateNodes(traces, 0)
+	r, a, b := nodeByName(nodes, "r"), nodeByName(nodes, "a"), nodeByName(nodes, "b")
+	if a.EdgeWeights[b] != 10 || b.EdgeWeights[a] != 10 || r.EdgeWeights[a] != 5 || r.EdgeWeights[b] != 5 {
+		t.Fatalf("unexpected graph: r -> a %d, r -> b %d, a -> b %d, b -> a %d",
+			r.EdgeWeights[a], r.EdgeWeights[b], a.EdgeWeights[b], b.EdgeWeights[a])
+	}
+	if removed := PruneEdges(nodes, 8); removed != 1 {
+		t.Errorf("got %d edges removed; want 1", removed)
+	}
+	// r keeps the edge to a (the lesser call site of the tied edges), and b is reached through a.
+	if _, ok := r.EdgeWeights[a]; !ok {
+		t.Error("r -> a was removed, leaving a and b unreachable from r")
+	}
+	if _, ok := r.EdgeWeights[b]; ok {
+		t.Error("r -> b was kept")
+	}
+	if stats := GraphStats(nodes); stats.Roots != 1 {
+		t.Errorf("got %d roots after pruning; want 1", stats.Roots)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The GraphML document structure, as far as it's needed here. See http://graphml.graphdrawing.org/.
+type graphML struct {
+	XMLName        xml.Name     `xml:"graphml"`
+	XMLNS          string       `xml:"xmlns,attr"`
+	XSI            string       `xml:"xmlns:xsi,attr"`
+	SchemaLocation string       `xml:"xsi:schemaLocation,attr"`
+	Keys           []graphMLKey `xml:"key"`
+	Graph          graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// graphMLKeys declares the attributes of nodes and edges.
+var graphMLKeys = []graphMLKey{
+	{ID: "name", For: "node", Name: "name", Type: "string"},
+	{ID: "file", For: "node", Name: "file", Type: "string"},
+	{ID: "line", For: "node", Name: "line", Type: "int"},
+	{ID: "self", For: "node", Name: "self", Type: "int"},
+	{ID: "cumulative", For: "node", Name: "cumulative", Type: "int"},
+	{ID: "weight", For: "edge", Name: "weight", Type: "int"},
+}
+
+// WriteGraphML writes the graph formed by nodes to w as GraphML, for tools such as Gephi and yEd. Nodes are
+// numbered in order, as in the DOT output. Only edges between members of nodes are written.
+func WriteGraphML(w io.Writer, nodes []*Node) error {
+	nums := make(map[*Node]int)
+	doc := graphML{
+		XMLNS:          "http://graphml.graphdrawing.org/xmlns",
+		XSI:            "http://www.w3.org/2001/XMLSchema-instance",
+		SchemaLocation: "http://graphml.graphdrawing.org/xmlns http://graphml.graphdrawing.org/xmlns/1.0/graphml.xsd",
+		Keys:           graphMLKeys,
+		Graph:          graphMLGraph{ID: "G", EdgeDefault: "directed"},
+	}
+	for i, node := range nodes {
+		nums[node] = i + 1
+		data := []graphMLData{{Key: "name", Value: node.Name}}
+		if !node.Synthetic {
+			data = append(data, graphMLData{Key: "file", Value: node.Filename})
+			if node.LineNumber > 0 {
+				data = append(data, graphMLData{Key: "line", Value: fmt.Sprint(node.LineNumber)})
+			}
+		}
+		data = append(data,
+			graphMLData{Key: "self", Value: fmt.Sprint(node.Count)},
+			graphMLData{Key: "cumulative", Value: fmt.Sprint(node.CumulativeCount)},
+		)
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{ID: fmt.Sprintf("n%d", i+1), Data: data})
+	}
+	for i, node := range nodes {
+		var children []*Node
+		for child := range node.EdgeWeights {
+			if _, ok := nums[child]; ok {
+				children = append(children, child)
+			}
+		}
+		sort.Slice(children, func(j, k int) bool { return nums[children[j]] < nums[children[k]] })
+		for _, child := range children {
+			doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+				Source: fmt.Sprintf("n%d", i+1),
+				Target: fmt.Sprintf("n%d", nums[child]),
+				Data:   []graphMLData{{Key: "weight", Value: fmt.Sprint(node.EdgeWeights[child])}},
+			})
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestWriteGraphML(t *testing.T) {
+	traces := sampleTraces(t)
+	opts := testOptions()
+	opts.Format = "graphml"
+	var buf strings.Builder
+	if err := WriteOutput(&buf, traces, opts); err != nil {
+		t.Fatal(err)
+	}
+	var doc graphML
+	if err := xml.Unmarshal([]byte(buf.String()), &doc); err != nil {
+		t.Fatalf("the output is not valid XML: %s\n%s", err, buf.String())
+	}
+	if len(doc.Graph.Nodes) != 8 || len(doc.Graph.Edges) != 8 {
+		t.Errorf("got %d nodes and %d edges; want 8 and 8", len(doc.Graph.Nodes), len(doc.Graph.Edges))
+	}
+	ids := make(map[string]bool)
+	var names []string
+	for _, node := range doc.Graph.Nodes {
+		ids[node.ID] = true
+		for _, d := range node.Data {
+			if d.Key == "name" {
+				names = append(names, d.Value)
+			}
+		}
+	}
+	for _, edge := range doc.Graph.Edges {
+		if !ids[edge.Source] || !ids[edge.Target] {
+			t.Errorf("edge %s -> %s refers to a missing node", edge.Source, edge.Target)
+		}
+	}
+	if names[0] != trickyName {
+		t.Errorf("the first node is named %q; want %q", names[0], trickyName)
+	}
+	if strings.Contains(buf.String(), "<K,V>") {
+		t.Error("the output has an unescaped method name")
+	}
+}
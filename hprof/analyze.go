@@ -0,0 +1,118 @@
+package hprof
+
+import (
+	"io"
+	"sort"
+)
+
+// A Result summarizes the analysis of a heap dump. Sizes are in bytes.
+type Result struct {
+	Strings         int
+	InvalidStrings  int // with Options.ValidateUTF8
+	Classes         int // loaded classes
+	UnloadedClasses int
+	StackTraces     int
+
+	Total                  int64 // estimated size of all the objects in the dump
+	InstanceOverhead       int64 // part of Total spent on object headers
+	ObjectArrayOverhead    int64
+	PrimitiveArrayOverhead int64
+
+	HeapSummary *HeapSummary // the JVM's own accounting, or nil if the dump has no HEAP SUMMARY record
+
+	TopStacks      []StackSize // the stacks that allocated the most bytes, largest first (at most 10)
+	Histogram      []ClassSize // all the classes, largest first, like jmap -histo
+	ClassHistogram []ClassSize // with Options.ClassFilter, the matching classes, largest first
+
+	Tags    [256]int // number of records of each tag
+	SubTags [256]int // number of heap dump sub-records of each sub-tag
+
+	Warnings []Warning
+
+	Heap *Heap // for more detailed reports
+}
+
+// A ClassSize is the number of instances of a class and the bytes they use.
+type ClassSize struct {
+	Name      string
+	Instances int
+	Size      int64
+}
+
+// Analyze reads the heap dump from r and computes its totals, histograms, and top stacks. If reading the dump
+// fails after it started, Analyze returns the error with a Result holding only the warnings found before it.
+func Analyze(r io.Reader, opts Options) (*Result, error) {
+	h, err := parse(r, opts)
+	if err != nil {
+		if h == nil {
+			return nil, err
+		}
+		return &Result{Warnings: h.Warnings}, err
+	}
+	return &Result{
+		Strings:         len(h.Strings),
+		InvalidStrings:  h.InvalidStrings,
+		Classes:         len(h.ClassByID),
+		UnloadedClasses: h.UnloadedClasses,
+		StackTraces:     len(h.TraceBySerial),
+
+		Total:                  h.Total,
+		InstanceOverhead:       h.InstanceOverhead,
+		ObjectArrayOverhead:    h.ObjectArrayOverhead,
+		PrimitiveArrayOverhead: h.PrimitiveArrayOverhead,
+
+		HeapSummary:    h.HeapSummary,
+		TopStacks:      h.TopStacks(h.TraceSizes, 10),
+		Histogram:      h.Histogram(),
+		ClassHistogram: h.classHistogram(),
+
+		Tags:     h.Tags,
+		SubTags:  h.SubTags,
+		Warnings: h.Warnings,
+
+		Heap: h,
+	}, nil
+}
+
+// Histogram returns the number and size of the objects of each class, largest first. Arrays are listed under
+// their array classes (such as "[Ljava/lang/String;"), except for primitive arrays, which are listed by
+// element type (such as "byte[]").
+func (h *Heap) Histogram() []ClassSize {
+	classes := make([]ClassSize, 0, len(h.ClassStats)+len(h.PrimitiveArrayStats))
+	for id, stats := range h.ClassStats {
+		classes = append(classes, ClassSize{Name: h.classNameByID(id), Instances: int(stats.Count), Size: stats.Bytes})
+	}
+	for typ, stats := range h.PrimitiveArrayStats {
+		classes = append(classes, ClassSize{
+			Name:      BasicTypeNames[typ] + "[]",
+			Instances: int(stats.Count),
+			Size:      stats.Bytes,
+		})
+	}
+	sortClassSizes(classes)
+	return classes
+}
+
+// classHistogram sums the sizes and instances of the classes matching the class filter.
+func (h *Heap) classHistogram() []ClassSize {
+	sizes := make(map[string]int64)
+	for ct, size := range h.ClassTraceSizes {
+		sizes[ct.Class] += size
+	}
+	classes := make([]ClassSize, 0, len(sizes))
+	for name, size := range sizes {
+		classes = append(classes, ClassSize{Name: name, Instances: h.ClassInstances[name], Size: size})
+	}
+	sortClassSizes(classes)
+	return classes
+}
+
+// sortClassSizes sorts classes by descending size, then by name.
+func sortClassSizes(classes []ClassSize) {
+	sort.Slice(classes, func(i, j int) bool {
+		if classes[i].Size != classes[j].Size {
+			return classes[i].Size > classes[j].Size
+		}
+		return classes[i].Name < classes[j].Name
+	})
+}
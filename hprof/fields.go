@@ -0,0 +1,106 @@
+package hprof
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// A Field is an instance field of a class.
+type Field struct {
+	Name string
+	Type byte // basic type (see BasicTypeNames)
+}
+
+// An Instance is an object instance (that is not an array), kept with Options.KeepInstances.
+type Instance struct {
+	ClassID     uint64 // class object ID
+	TraceSerial uint32 // stack trace serial of the allocation
+	Data        []byte // packed field values (see Heap.Fields)
+}
+
+// A FieldValue is the value of an instance field. Value is a uint64 object ID (0 for null) for object fields,
+// and a bool, uint16 (for char), float32, float64, int8, int16, int32, or int64 for the others.
+type FieldValue struct {
+	Field
+	Class string // name of the class that declares the field
+	Value interface{}
+}
+
+// InstanceFields returns the instance fields of the class with the given class object ID, including the
+// inherited ones, in the order that the values of an instance are dumped in: the fields declared by the class
+// itself first, followed by those of its superclass, and so on.
+func (h *Heap) InstanceFields(classID uint64) ([]FieldValue, error) {
+	var fields []FieldValue
+	// Limit the walk up the superclasses in case of a cycle, which only a corrupt dump could have.
+	for id, n := classID, 0; id != 0; n++ {
+		c, ok := h.ClassByID[id]
+		if !ok {
+			return nil, fmt.Errorf("unknown class object ID %#x", id)
+		}
+		if n > len(h.ClassByID) {
+			return nil, fmt.Errorf("class %s has a cycle of superclasses", c.Name)
+		}
+		for _, f := range c.Fields {
+			fields = append(fields, FieldValue{Field: f, Class: c.Name})
+		}
+		id = c.SuperID
+	}
+	return fields, nil
+}
+
+// Fields decodes the field values of the instance with the given object ID, in the order of InstanceFields.
+// It requires Options.KeepInstances.
+func (h *Heap) Fields(objectID uint64) ([]FieldValue, error) {
+	inst, ok := h.Instances[objectID]
+	if !ok {
+		return nil, fmt.Errorf("no instance with object ID %#x", objectID)
+	}
+	fields, err := h.InstanceFields(inst.ClassID)
+	if err != nil {
+		return nil, fmt.Errorf("object %#x: %s", objectID, err)
+	}
+	data := inst.Data
+	for i := range fields {
+		size := typeSize(fields[i].Type, h.IDSize)
+		if size > len(data) {
+			return nil, fmt.Errorf("object %#x: field values end at field %s.%s",
+				objectID, fields[i].Class, fields[i].Name)
+		}
+		fields[i].Value = decodeValue(fields[i].Type, data[:size])
+		data = data[size:]
+	}
+	if len(data) > 0 {
+		return nil, fmt.Errorf("object %#x: %d bytes of field values left over after the fields of its classes",
+			objectID, len(data))
+	}
+	return fields, nil
+}
+
+// decodeValue decodes the value of the basic type in b, which is as long as the type's size.
+func decodeValue(typ byte, b []byte) interface{} {
+	switch typ {
+	case 2: // object
+		if len(b) == 4 {
+			return uint64(binary.BigEndian.Uint32(b))
+		}
+		return binary.BigEndian.Uint64(b)
+	case 4: // boolean
+		return b[0] != 0
+	case 5: // char
+		return binary.BigEndian.Uint16(b)
+	case 6: // float
+		return math.Float32frombits(binary.BigEndian.Uint32(b))
+	case 7: // double
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	case 8: // byte
+		return int8(b[0])
+	case 9: // short
+		return int16(binary.BigEndian.Uint16(b))
+	case 10: // int
+		return int32(binary.BigEndian.Uint32(b))
+	case 11: // long
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	panic(fmt.Sprintf("decodeValue: bad basic type %d", typ))
+}
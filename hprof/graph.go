@@ -0,0 +1,407 @@
+package hprof
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Kinds of objects in the object graph.
+const (
+	instanceObject byte = iota
+	objectArrayObject
+	primitiveArrayObject
+	classObject
+)
+
+// An objectGraph records the objects of a dump and the references between them, with Options.ObjectGraph.
+// To keep its memory use down on large dumps, the references of each object are kept as the IDs of the
+// objects referred to, appended to one slice as the objects are read, and only resolved to objects while
+// walking the graph.
+type objectGraph struct {
+	index map[uint64]int32 // by object ID
+
+	// By object index.
+	ids       []uint64
+	kinds     []byte
+	classes   []uint64 // class object ID (for classes, their own), or basic type for primitive arrays
+	sizes     []int64
+	refStart  []int   // into refs
+	refCounts []int32 // number of refs
+
+	refs []uint64 // object IDs referred to, which may be 0 or not in the dump
+
+	// Instances read before the layouts of their classes, to add the references of once all the records
+	// have been read.
+	deferred map[int32][]byte
+
+	refOffsets map[uint64][]int // offsets of the object fields in the values of an instance, by class
+	buf        []byte           // for reading instance field values
+}
+
+func newObjectGraph() *objectGraph {
+	return &objectGraph{
+		index:      make(map[uint64]int32),
+		deferred:   make(map[int32][]byte),
+		refOffsets: make(map[uint64][]int),
+	}
+}
+
+// add adds an object with references to the object IDs in refs.
+func (g *objectGraph) add(id uint64, kind byte, class uint64, size int64, refs []uint64) int32 {
+	i := int32(len(g.ids))
+	g.index[id] = i
+	g.ids = append(g.ids, id)
+	g.kinds = append(g.kinds, kind)
+	g.classes = append(g.classes, class)
+	g.sizes = append(g.sizes, size)
+	g.refStart = append(g.refStart, len(g.refs))
+	g.refCounts = append(g.refCounts, int32(len(refs)))
+	g.refs = append(g.refs, refs...)
+	return i
+}
+
+// objectRefOffsets returns the offsets of the object fields in the values of an instance of the class with
+// the given class object ID, or false if the layout of the class or one of its superclasses isn't known yet. A
+// cycle of superclasses is an error.
+func (r *reader) objectRefOffsets(classID uint64) ([]int, bool) {
+	g := r.graph
+	if offsets, ok := g.refOffsets[classID]; ok {
+		return offsets, true
+	}
+	// As in InstanceFields, limit the walk up the superclasses in case of a cycle.
+	for id, n := classID, 0; id != 0; n++ {
+		c, ok := r.ClassByID[id]
+		if !ok || c.Fields == nil {
+			return nil, false
+		}
+		if n > len(r.ClassByID) {
+			r.errorf("class %s has a cycle of superclasses", c.Name)
+		}
+		id = c.SuperID
+	}
+	fields, err := r.InstanceFields(classID)
+	if err != nil {
+		return nil, false
+	}
+	offsets := []int{} // non-nil, for classes without object fields
+	offset := 0
+	for _, f := range fields {
+		if f.Type == 2 { // object
+			offsets = append(offsets, offset)
+		}
+		offset += typeSize(f.Type, r.IDSize)
+	}
+	g.refOffsets[classID] = offsets
+	return offsets, true
+}
+
+// addInstance adds the instance whose n bytes of field values are next in the dump.
+func (r *reader) addInstance(id, classID uint64, size, n int64) int32 {
+	g := r.graph
+	if int64(cap(g.buf)) < n {
+		g.buf = make([]byte, n)
+	}
+	data := g.buf[:n]
+	if _, err := io.ReadFull(r, data); err != nil {
+		r.error(err)
+	}
+	return r.addInstanceData(id, classID, size, data)
+}
+
+// addInstanceData adds the instance with the given field values, which it doesn't retain.
+func (r *reader) addInstanceData(id, classID uint64, size int64, data []byte) int32 {
+	g := r.graph
+	offsets, ok := r.objectRefOffsets(classID)
+	if !ok {
+		i := g.add(id, instanceObject, classID, size, nil)
+		g.deferred[i] = append([]byte(nil), data...)
+		return i
+	}
+	return g.add(id, instanceObject, classID, size, r.decodeRefs(offsets, data))
+}
+
+// decodeRefs returns the object IDs at the given offsets in data.
+func (r *reader) decodeRefs(offsets []int, data []byte) []uint64 {
+	refs := make([]uint64, 0, len(offsets))
+	for _, offset := range offsets {
+		if offset+r.IDSize > len(data) {
+			break
+		}
+		refs = append(refs, decodeValue(2, data[offset:offset+r.IDSize]).(uint64))
+	}
+	return refs
+}
+
+// finishGraph adds the references of the deferred instances, whose class layouts are now known.
+func (r *reader) finishGraph() {
+	g := r.graph
+	for i, data := range g.deferred {
+		offsets, ok := r.objectRefOffsets(g.classes[i])
+		if !ok {
+			r.warnf(-1, "object-graph", "no layout for class %s of object %#x; ignoring its references",
+				r.className(g.classes[i]), g.ids[i])
+			continue
+		}
+		refs := r.decodeRefs(offsets, data)
+		g.refStart[i] = len(g.refs)
+		g.refCounts[i] = int32(len(refs))
+		g.refs = append(g.refs, refs...)
+	}
+	g.deferred = nil
+	g.refOffsets = nil
+	g.buf = nil
+}
+
+// A DominatorTree is the dominator tree of the objects reachable from the GC roots: an object dominates
+// another if every path from the roots to the other goes through it. An object's retained size is the total
+// size of the objects it dominates (including itself), which could be freed if it was.
+type DominatorTree struct {
+	h        *Heap
+	idom     []int32 // immediate dominator, by object index; -1 if unreachable, len(ids) for the roots
+	retained []int64
+
+	Reachable      int   // number of objects reachable from the roots
+	ReachableBytes int64 // their total size
+}
+
+// A RetainedObject is an object and its retained size.
+type RetainedObject struct {
+	ID       uint64
+	Class    string // name of its class, such as "java/lang/String", "byte[]", or "class java/lang/String"
+	Size     int64  // shallow size
+	Retained int64
+}
+
+// Dominators computes the dominator tree of the objects, which requires Options.ObjectGraph. Class objects
+// are included, with a size of 0, for their static fields.
+func (h *Heap) Dominators() (*DominatorTree, error) {
+	g := h.graph
+	if g == nil {
+		return nil, errors.New("no object graph (it requires Options.ObjectGraph)")
+	}
+	n := len(g.ids)
+	root := int32(n) // a virtual root referring to all the GC roots
+
+	// Number the reachable objects in postorder with an iterative depth-first search, collecting the
+	// references between them for the predecessors below.
+	postorder := make([]int32, n+1)
+	for i := range postorder {
+		postorder[i] = -1
+	}
+	visited := make([]bool, n+1)
+	var order []int32 // by postorder number
+	type frame struct {
+		v    int32
+		next int32 // index of the next reference to follow
+	}
+	var rootRefs []int32
+	for _, r := range h.Roots {
+		if i, ok := g.index[r.ID]; ok {
+			rootRefs = append(rootRefs, i)
+		}
+	}
+	refsOf := func(v int32) []uint64 {
+		if v == root {
+			return nil
+		}
+		start := g.refStart[v]
+		return g.refs[start : start+int(g.refCounts[v])]
+	}
+	target := func(v, k int32) (int32, bool) {
+		if v == root {
+			return rootRefs[k], true
+		}
+		w, ok := g.index[refsOf(v)[k]]
+		return w, ok
+	}
+	numRefs := func(v int32) int32 {
+		if v == root {
+			return int32(len(rootRefs))
+		}
+		return g.refCounts[v]
+	}
+	predCounts := make([]int32, n+1)
+	stack := []frame{{v: root}}
+	visited[root] = true
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next == numRefs(top.v) {
+			postorder[top.v] = int32(len(order))
+			order = append(order, top.v)
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		w, ok := target(top.v, top.next)
+		top.next++
+		if !ok {
+			continue
+		}
+		predCounts[w]++
+		if !visited[w] {
+			visited[w] = true
+			stack = append(stack, frame{v: w})
+		}
+	}
+
+	// Collect the predecessors of each reachable object, in compressed form.
+	predStart := make([]int, n+2)
+	for v := 0; v <= n; v++ {
+		predStart[v+1] = predStart[v] + int(predCounts[v])
+	}
+	preds := make([]int32, predStart[n+1])
+	fill := append([]int(nil), predStart[:n+1]...)
+	for _, v := range order {
+		for k := int32(0); k < numRefs(v); k++ {
+			if w, ok := target(v, k); ok {
+				preds[fill[w]] = v
+				fill[w]++
+			}
+		}
+	}
+
+	// Compute the immediate dominators with the iterative algorithm of Cooper, Harvey, and Kennedy, "A
+	// Simple, Fast Dominance Algorithm", visiting the objects in reverse postorder until nothing changes.
+	idom := make([]int32, n+1)
+	for i := range idom {
+		idom[i] = -1
+	}
+	idom[root] = root
+	intersect := func(a, b int32) int32 {
+		for a != b {
+			for postorder[a] < postorder[b] {
+				a = idom[a]
+			}
+			for postorder[b] < postorder[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for k := len(order) - 2; k >= 0; k-- { // the root is last
+			v := order[k]
+			newIdom := int32(-1)
+			for _, p := range preds[predStart[v]:predStart[v+1]] {
+				if idom[p] == -1 {
+					continue
+				}
+				if newIdom == -1 {
+					newIdom = p
+				} else {
+					newIdom = intersect(p, newIdom)
+				}
+			}
+			if idom[v] != newIdom {
+				idom[v] = newIdom
+				changed = true
+			}
+		}
+	}
+
+	// Sum the retained sizes up the tree: an object comes before its dominators in postorder.
+	t := &DominatorTree{h: h, idom: idom[:n], retained: make([]int64, n+1)}
+	for _, v := range order {
+		if v == root {
+			continue
+		}
+		t.retained[v] += g.sizes[v]
+		t.retained[idom[v]] += t.retained[v]
+		t.Reachable++
+		t.ReachableBytes += g.sizes[v]
+	}
+	t.retained = t.retained[:n]
+	return t, nil
+}
+
+// Retained returns the retained size of the object with the given ID, or 0 if it isn't reachable.
+func (t *DominatorTree) Retained(id uint64) int64 {
+	if i, ok := t.h.graph.index[id]; ok {
+		return t.retained[i]
+	}
+	return 0
+}
+
+// Dominator returns the ID of the immediate dominator of the object with the given ID. It returns false if
+// the object is dominated by the roots alone or isn't reachable.
+func (t *DominatorTree) Dominator(id uint64) (uint64, bool) {
+	i, ok := t.h.graph.index[id]
+	if !ok {
+		return 0, false
+	}
+	d := t.idom[i]
+	if d < 0 || int(d) == len(t.idom) {
+		return 0, false
+	}
+	return t.h.graph.ids[d], true
+}
+
+// Top returns the n objects with the largest retained sizes, largest first. It returns nil if n isn't
+// positive.
+func (t *DominatorTree) Top(n int) []RetainedObject {
+	if n <= 0 {
+		return nil
+	}
+	var h retainedHeap
+	for i, size := range t.retained {
+		if t.idom[i] < 0 {
+			continue
+		}
+		if len(h) < n {
+			heap.Push(&h, retainedIndex{int32(i), size})
+		} else if size > h[0].size {
+			h[0] = retainedIndex{int32(i), size}
+			heap.Fix(&h, 0)
+		}
+	}
+	top := make([]RetainedObject, len(h))
+	for k := len(top) - 1; k >= 0; k-- {
+		ri := heap.Pop(&h).(retainedIndex)
+		top[k] = RetainedObject{
+			ID:       t.h.graph.ids[ri.i],
+			Class:    t.h.objectClassName(ri.i),
+			Size:     t.h.graph.sizes[ri.i],
+			Retained: ri.size,
+		}
+	}
+	return top
+}
+
+// objectClassName returns the name of the class of the object with the given index in the graph.
+func (h *Heap) objectClassName(i int32) string {
+	g := h.graph
+	switch g.kinds[i] {
+	case primitiveArrayObject:
+		return BasicTypeNames[byte(g.classes[i])] + "[]"
+	case classObject:
+		return "class " + h.classNameByID(g.classes[i])
+	}
+	return h.classNameByID(g.classes[i])
+}
+
+func (h *Heap) classNameByID(classObjectID uint64) string {
+	if c, ok := h.ClassByID[classObjectID]; ok {
+		return c.Name
+	}
+	return fmt.Sprintf("<unknown class %#x>", classObjectID)
+}
+
+type retainedIndex struct {
+	i    int32
+	size int64
+}
+
+type retainedHeap []retainedIndex
+
+func (s *retainedHeap) Len() int           { return len(*s) }
+func (s *retainedHeap) Less(i, j int) bool { return (*s)[i].size < (*s)[j].size }
+func (s *retainedHeap) Swap(i, j int)      { (*s)[i], (*s)[j] = (*s)[j], (*s)[i] }
+func (s *retainedHeap) Push(x interface{}) { *s = append(*s, x.(retainedIndex)) }
+func (s *retainedHeap) Pop() interface{} {
+	n := len(*s)
+	v := (*s)[n-1]
+	*s = (*s)[:n-1]
+	return v
+}
@@ -0,0 +1,154 @@
+package hprof
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// loadClass appends a LOAD CLASS record.
+func (d *dump) loadClass(serial uint32, id, nameID uint64) {
+	b := d.body()
+	b.u4(serial)
+	b.id(id)
+	b.u4(0) // stack trace serial
+	b.id(nameID)
+	d.record(0x02, b)
+}
+
+// classDump appends a CLASS DUMP sub-record for a class whose instance fields all refer to objects.
+func (d *dump) classDump(id, superID uint64, fieldNameIDs ...uint64) {
+	d.u1(0x20)
+	d.id(id)
+	d.u4(0) // stack trace serial
+	d.id(superID)
+	for i := 0; i < 5; i++ {
+		d.id(0) // class loader, signers, protection domain, reserved
+	}
+	d.u4(uint32(len(fieldNameIDs) * d.idSize))
+	d.u2(0) // constant pool
+	d.u2(0) // static fields
+	d.u2(uint16(len(fieldNameIDs)))
+	for _, nameID := range fieldNameIDs {
+		d.id(nameID)
+		d.u1(2) // object
+	}
+}
+
+// instanceDump appends an INSTANCE DUMP sub-record for an instance whose fields refer to the given objects.
+func (d *dump) instanceDump(id, classID uint64, refs ...uint64) {
+	d.u1(0x21)
+	d.id(id)
+	d.u4(0) // stack trace serial
+	d.id(classID)
+	d.u4(uint32(len(refs) * d.idSize))
+	for _, ref := range refs {
+		d.id(ref)
+	}
+}
+
+func TestDominators(t *testing.T) {
+	// 1 refers to 2 and 3, which both refer to 4, so 4 is dominated by 1 alone. 4 refers to 5, which refers
+	// to an array of 6, which refers back to 5 and to a byte array, 7. 9 refers to 1, but isn't reachable.
+	d := newDump(8)
+	d.str(1, "Node")
+	d.str(2, "a")
+	d.str(3, "b")
+	d.str(4, "java/lang/Object")
+	d.str(5, "[LNode;")
+	d.loadClass(1, 100, 1)
+	d.loadClass(2, 101, 4)
+	d.loadClass(3, 102, 5)
+	seg := d.body()
+	seg.u1(0x01) // ROOT JNI GLOBAL
+	seg.id(1)
+	seg.id(0)
+	seg.instanceDump(1, 100, 2, 3)
+	seg.instanceDump(2, 100, 4, 0)
+	seg.instanceDump(3, 100, 4, 0)
+	seg.instanceDump(4, 100, 5, 0)
+	seg.instanceDump(5, 100, 6, 0)
+	seg.u1(0x22) // OBJECT ARRAY DUMP
+	seg.id(6)
+	seg.u4(0)
+	seg.u4(2)
+	seg.id(102)
+	seg.id(7)
+	seg.id(5)
+	seg.u1(0x23) // PRIMITIVE ARRAY DUMP
+	seg.id(7)
+	seg.u4(0)
+	seg.u4(10)
+	seg.u1(8) // byte
+	seg.WriteString("0123456789")
+	seg.instanceDump(9, 100, 1, 0)
+	// The class dumps come last, so that the references of the instances are resolved at the end.
+	seg.classDump(101, 0)
+	seg.classDump(100, 101, 2, 3)
+	d.record(0x1c, seg)
+
+	h, err := ParseOptions(bytes.NewReader(d.Bytes()), Options{ObjectGraph: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := h.Dominators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Instances are 16+16 bytes, the object array 24+16, and the byte array 24+10.
+	for _, tt := range []struct {
+		id       uint64
+		retained int64
+		dom      uint64 // 0 for none
+	}{
+		{1, 234, 0},
+		{2, 32, 1},
+		{3, 32, 1},
+		{4, 138, 1},
+		{5, 106, 4},
+		{6, 74, 5},
+		{7, 34, 6},
+		{9, 0, 0},
+	} {
+		if got := tree.Retained(tt.id); got != tt.retained {
+			t.Errorf("Retained(%d) = %d; want %d", tt.id, got, tt.retained)
+		}
+		dom, ok := tree.Dominator(tt.id)
+		if !ok {
+			dom = 0
+		}
+		if dom != tt.dom {
+			t.Errorf("Dominator(%d) = %d, %t; want %d", tt.id, dom, ok, tt.dom)
+		}
+	}
+	if tree.Reachable != 7 || tree.ReachableBytes != 234 {
+		t.Errorf("got %d reachable objects of %d bytes; want 7 of 234", tree.Reachable, tree.ReachableBytes)
+	}
+	top := tree.Top(2)
+	if len(top) != 2 || top[0].ID != 1 || top[1].ID != 4 || top[0].Class != "Node" {
+		t.Errorf("Top(2) = %+v; want objects 1 and 4, of class Node", top)
+	}
+	for _, n := range []int{0, -1} {
+		if top := tree.Top(n); top != nil {
+			t.Errorf("Top(%d) = %+v; want nil", n, top)
+		}
+	}
+}
+
+func TestSuperclassCycle(t *testing.T) {
+	d := newDump(8)
+	d.str(1, "A")
+	d.str(2, "B")
+	d.loadClass(1, 100, 1)
+	d.loadClass(2, 101, 2)
+	seg := d.body()
+	seg.classDump(100, 101)
+	seg.classDump(101, 100)
+	seg.instanceDump(1, 100)
+	d.record(0x1c, seg)
+
+	_, err := ParseOptions(bytes.NewReader(d.Bytes()), Options{ObjectGraph: true})
+	if err == nil || !strings.Contains(err.Error(), "cycle of superclasses") {
+		t.Fatalf("got error %v; want a superclass cycle error", err)
+	}
+}
@@ -0,0 +1,1012 @@
+// Package hprof parses heap dumps in the binary hprof format, as written by jmap and
+// -XX:+HeapDumpOnOutOfMemoryError.
+package hprof
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cespare/hprofviz/internal/infile"
+)
+
+// A Heap is the decoded content of a heap dump. Sizes are in bytes.
+type Heap struct {
+	IDSize int // size of object IDs in the dump: 4 or 8
+
+	Strings        map[uint64]string
+	InvalidStrings int // with Options.ValidateUTF8, strings that weren't valid UTF-8
+	ClassByID      map[uint64]*Class
+	ClassBySerial  map[uint32]*Class
+	FrameByID      map[uint64]*Frame
+	TraceBySerial  map[uint32]*Trace
+
+	// Per-object header sizes used for the sizes below (see Options).
+	InstanceHeaderSize       int64
+	ObjectArrayHeaderSize    int64
+	PrimitiveArrayHeaderSize int64
+
+	Total                  int64 // estimated size of all the objects in the dump
+	InstanceOverhead       int64 // part of Total spent on object headers
+	ObjectArrayOverhead    int64
+	PrimitiveArrayOverhead int64
+	TraceSizes             map[uint32]int64 // bytes allocated, by stack trace serial
+
+	// Number and size of the objects of each class, by class object ID. Primitive arrays, which have no class
+	// object, are counted by element type instead.
+	ClassStats          map[uint64]*ClassStats
+	PrimitiveArrayStats map[byte]*ClassStats
+
+	// With Options.KeepInstances, the instances, by object ID.
+	Instances map[uint64]*Instance
+
+	// With Options.ClassFilter, sizes and instance counts of objects of matching classes.
+	ClassTraceSizes map[ClassTrace]int64
+	ClassInstances  map[string]int
+
+	// GC roots. Classes of rooted objects are only counted for objects dumped after their root records (as
+	// HotSpot does).
+	Roots       []Root
+	RootKinds   map[uint64]byte // first root kind, by object ID
+	RootClasses map[string]int  // number of rooted objects, by class name
+
+	HeapSummary     *HeapSummary // nil if the dump has no HEAP SUMMARY record
+	UnloadedClasses int
+
+	HasTimestamps bool // whether any record had a nonzero timestamp
+	CPUSamples    []CPUSamples
+
+	Tags    [256]int // number of records of each tag
+	SubTags [256]int // number of heap dump sub-records of each sub-tag
+
+	Warnings []Warning
+
+	graph *objectGraph // with Options.ObjectGraph
+}
+
+// Options control ParseOptions. The zero Options use the default header sizes and don't validate strings.
+type Options struct {
+	ValidateUTF8 bool // check that strings are valid UTF-8, replacing invalid sequences
+	StrictUTF8   bool // with ValidateUTF8, invalid strings are an error rather than a warning
+
+	// KeepInstances keeps the field values of each instance (Heap.Instances), so that they can be decoded with
+	// Heap.Fields. This takes about as much memory as the instances took in the JVM.
+	KeepInstances bool
+
+	// ObjectGraph records the references between objects, for Heap.Dominators.
+	ObjectGraph bool
+
+	// ClassFilter, if non-nil, selects the classes to record sizes for (Heap.ClassTraceSizes).
+	ClassFilter *regexp.Regexp
+
+	// Per-object header sizes, which the dump doesn't record. Zero means the default for the dump's id size
+	// (that of 64-bit OpenJDK 8 for 8-byte ids, or of a 32-bit VM for 4-byte ids).
+	InstanceHeaderSize       int64
+	ObjectArrayHeaderSize    int64
+	PrimitiveArrayHeaderSize int64
+}
+
+// Parse reads the heap dump from r with the default Options.
+func Parse(r io.Reader) (*Heap, error) {
+	return ParseOptions(r, Options{})
+}
+
+// ParseOptions reads the heap dump from r, which may be gzip-compressed.
+func ParseOptions(r io.Reader, opts Options) (*Heap, error) {
+	h, err := parse(r, opts)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// parse is ParseOptions, but on failure, it also returns what was read of the dump, if anything.
+func parse(r io.Reader, opts Options) (*Heap, error) {
+	r, err := infile.MaybeGunzip(r)
+	if err != nil {
+		return nil, err
+	}
+	rd := newReader(r)
+	rd.validateUTF8 = opts.ValidateUTF8
+	rd.strictUTF8 = opts.StrictUTF8
+	rd.classFilter = opts.ClassFilter
+	rd.keepInstances = opts.KeepInstances
+	if opts.ObjectGraph {
+		rd.graph = newObjectGraph()
+	}
+	rd.InstanceHeaderSize = opts.InstanceHeaderSize
+	rd.ObjectArrayHeaderSize = opts.ObjectArrayHeaderSize
+	rd.PrimitiveArrayHeaderSize = opts.PrimitiveArrayHeaderSize
+	if err := rd.readAll(); err != nil {
+		return rd.Heap, err
+	}
+	return rd.Heap, nil
+}
+
+type reader struct {
+	*bufio.Reader
+	*Heap
+
+	scratch [8]byte
+	pending []func() error // unresolved forward references to strings
+
+	validateUTF8  bool // check that strings are valid UTF-8
+	strictUTF8    bool // with validateUTF8, invalid strings are an error rather than being fixed up
+	classFilter   *regexp.Regexp
+	keepInstances bool
+
+	recordTime time.Duration // timestamp of the current record, relative to the header
+
+	in *infile.CountingReader
+}
+
+func newReader(r io.Reader) *reader {
+	in := &infile.CountingReader{R: r}
+	return &reader{
+		Reader: bufio.NewReader(in),
+		in:     in,
+		Heap: &Heap{
+			Strings:       make(map[uint64]string),
+			ClassByID:     make(map[uint64]*Class),
+			ClassBySerial: make(map[uint32]*Class),
+			FrameByID:     make(map[uint64]*Frame),
+			TraceBySerial: make(map[uint32]*Trace),
+			TraceSizes:    make(map[uint32]int64),
+
+			Instances:           make(map[uint64]*Instance),
+			ClassStats:          make(map[uint64]*ClassStats),
+			PrimitiveArrayStats: make(map[byte]*ClassStats),
+
+			ClassTraceSizes: make(map[ClassTrace]int64),
+			ClassInstances:  make(map[string]int),
+			RootKinds:       make(map[uint64]byte),
+			RootClasses:     make(map[string]int),
+		},
+	}
+}
+
+// These header sizes are correct for 64-bit OpenJDK 8, empirically. Other VMs and settings (such as
+// -XX:-UseCompressedClassPointers, or a 32-bit VM) differ. To find the right values for a VM, use JOL
+// (org.openjdk.jol.info.ClassLayout) in that VM to print the layouts of an Object, an Object[0], and an
+// int[0], and give the header sizes it reports in the Options.
+const (
+	DefaultInstanceHeaderSize       = 16
+	DefaultObjectArrayHeaderSize    = 24
+	DefaultPrimitiveArrayHeaderSize = 24
+)
+
+type headerSizes struct {
+	instance, objectArray, primitiveArray int64
+}
+
+// idSizeHeaderSizes are the default header sizes for each id size. Dumps with 4-byte ids come from 32-bit VMs,
+// whose objects have an 8-byte header (4 mark + 4 class) and whose arrays have a 12-byte one (plus 4 length).
+var idSizeHeaderSizes = map[int]headerSizes{
+	4: {instance: 8, objectArray: 12, primitiveArray: 12},
+	8: {
+		instance:       DefaultInstanceHeaderSize,
+		objectArray:    DefaultObjectArrayHeaderSize,
+		primitiveArray: DefaultPrimitiveArrayHeaderSize,
+	},
+}
+
+// A Warning is a problem with the dump or the analysis that doesn't prevent a result.
+type Warning struct {
+	Offset   int64  `json:"offset"` // position in the dump, or -1 if not related to one
+	Category string `json:"category"`
+	Detail   string `json:"detail"`
+}
+
+// offset returns the position in the dump of the next byte to be read.
+func (r *reader) offset() int64 {
+	return r.in.N - int64(r.Buffered())
+}
+
+// warnf records a warning about the data at offset (or -1).
+func (r *reader) warnf(offset int64, category, format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, Warning{offset, category, fmt.Sprintf(format, args...)})
+}
+
+type readerError struct {
+	err error
+}
+
+func (r *reader) error(err error) {
+	panic(readerError{err})
+}
+
+func (r *reader) errorf(format string, args ...interface{}) {
+	r.error(fmt.Errorf(format, args...))
+}
+
+func (r *reader) u1() byte {
+	b := r.scratch[:1]
+	if _, err := io.ReadFull(r, b); err != nil {
+		r.error(err)
+	}
+	return b[0]
+}
+
+func (r *reader) u2() uint16 {
+	b := r.scratch[:2]
+	if _, err := io.ReadFull(r, b); err != nil {
+		r.error(err)
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) u4() uint32 {
+	b := r.scratch[:4]
+	if _, err := io.ReadFull(r, b); err != nil {
+		r.error(err)
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *reader) u8() uint64 {
+	b := r.scratch[:8]
+	if _, err := io.ReadFull(r, b); err != nil {
+		r.error(err)
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *reader) id() uint64 {
+	if r.IDSize == 4 {
+		return uint64(r.u4())
+	}
+	return r.u8()
+}
+
+func (r *reader) bytes(n int) []byte {
+	var b []byte
+	if n <= len(r.scratch) {
+		b = r.scratch[:n]
+	} else {
+		b = make([]byte, n)
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		r.error(err)
+	}
+	return b
+}
+
+func (r *reader) ignore(n int64) {
+	if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+		r.error(err)
+	}
+}
+
+// A Class is a loaded class.
+type Class struct {
+	Serial           uint32
+	ID               uint64 // of the class object
+	StackTraceSerial uint32
+	Name             string // such as "java/lang/String"
+
+	// From the class's CLASS DUMP record, if any.
+	SuperID      uint64  // class object ID of the superclass, or 0 for none
+	InstanceSize uint32  // size of the instance field values, as the JVM reports it
+	Fields       []Field // instance fields declared by the class itself, in dump order
+}
+
+// A Frame is a stack frame.
+type Frame struct {
+	ID        uint64
+	Method    string
+	Signature string
+	Filename  string // or "<unknown>"
+	Class     *Class
+	Line      uint32
+}
+
+// A Trace is a stack trace.
+type Trace struct {
+	Serial       uint32
+	ThreadSerial uint32
+	Frames       []*Frame // innermost first
+}
+
+func (r *reader) readString(n int64) {
+	offset := r.offset()
+	if n < int64(r.IDSize) {
+		r.errorf("string record of %d bytes is too short for its %d-byte id", n, r.IDSize)
+	}
+	id := r.id()
+	s := string(r.bytes(int(n - int64(r.IDSize))))
+	// Note that hprof strings are really Java's "modified UTF-8", which differs from UTF-8 in its encoding of
+	// NUL and supplementary characters. Those are rare in class and method names, so they are flagged too.
+	if r.validateUTF8 && !utf8.ValidString(s) {
+		r.InvalidStrings++
+		if r.strictUTF8 {
+			r.errorf("string %d is not valid UTF-8: %q", id, s)
+		}
+		r.warnf(offset, "invalid-utf8", "string %d is not valid UTF-8: %q", id, s)
+		s = strings.ToValidUTF8(s, "\uFFFD")
+	}
+	r.Strings[id] = s
+}
+
+// resolveString sets *dst to the string with the given ID. Records usually only refer to strings defined
+// earlier in the dump, but in case a string isn't defined yet, resolution is retried once all the records
+// have been read (see resolvePending). If the string is still unknown then, it is an error, described by
+// format (which is given the ID).
+func (r *reader) resolveString(id uint64, dst *string, format string) {
+	if s, ok := r.Strings[id]; ok {
+		*dst = s
+		return
+	}
+	r.pending = append(r.pending, func() error {
+		s, ok := r.Strings[id]
+		if !ok {
+			return fmt.Errorf(format, id)
+		}
+		*dst = s
+		return nil
+	})
+}
+
+// resolvePending resolves the forward references recorded by resolveString.
+func (r *reader) resolvePending() {
+	for _, resolve := range r.pending {
+		if err := resolve(); err != nil {
+			r.error(err)
+		}
+	}
+	r.pending = nil
+}
+
+func (r *reader) readClass(_ int64) {
+	serial := r.u4()
+	id := r.id()
+	stackTraceSerial := r.u4()
+	nameID := r.id()
+	c := &Class{
+		Serial:           serial,
+		ID:               id,
+		StackTraceSerial: stackTraceSerial,
+	}
+	r.resolveString(nameID, &c.Name, "class referred to unknown name %d")
+	r.ClassByID[id] = c
+	r.ClassBySerial[serial] = c
+}
+
+func (r *reader) unloadClass(_ int64) {
+	serial := r.u4()
+	c, ok := r.ClassBySerial[serial]
+	if !ok {
+		r.errorf("unload referred to unknown class serial %d", serial)
+	}
+	delete(r.ClassBySerial, serial)
+	delete(r.ClassByID, c.ID)
+	r.UnloadedClasses++
+}
+
+// A HeapSummary is the JVM's own accounting of the heap, as reported in a HEAP SUMMARY record.
+type HeapSummary struct {
+	LiveBytes          uint32
+	LiveInstances      uint32
+	AllocatedBytes     uint64
+	AllocatedInstances uint64
+}
+
+func (r *reader) readHeapSummary(_ int64) {
+	r.HeapSummary = &HeapSummary{
+		LiveBytes:          r.u4(),
+		LiveInstances:      r.u4(),
+		AllocatedBytes:     r.u8(),
+		AllocatedInstances: r.u8(),
+	}
+}
+
+// CPUSamples is the content of a single CPU SAMPLES record.
+type CPUSamples struct {
+	Time   time.Duration    // since the dump's header
+	Counts map[uint32]int64 // by trace serial
+}
+
+func (r *reader) readCPUSamples(n int64) {
+	r.u4() // total number of samples
+	numTraces := int64(r.u4())
+	if n < 4+4 || numTraces*(4+4) > n-(4+4) {
+		r.errorf("CPU samples record has %d traces, more than its %d bytes hold", numTraces, n)
+	}
+	s := CPUSamples{Time: r.recordTime, Counts: make(map[uint32]int64)}
+	for i := int64(0); i < numTraces; i++ {
+		count := r.u4()
+		serial := r.u4()
+		s.Counts[serial] += int64(count)
+	}
+	r.CPUSamples = append(r.CPUSamples, s)
+}
+
+// CPUSampleCounts sums the sample counts by trace serial over all CPU SAMPLES records in the window
+// [start, end]. An end of 0 means there is no upper bound. If the dump has no record timestamps, the window
+// is ignored. It also returns the number of records in the window.
+func (h *Heap) CPUSampleCounts(start, end time.Duration) (counts map[uint32]int64, inWindow int) {
+	counts = make(map[uint32]int64)
+	for _, s := range h.CPUSamples {
+		if h.HasTimestamps && (s.Time < start || (end > 0 && s.Time > end)) {
+			continue
+		}
+		inWindow++
+		for serial, count := range s.Counts {
+			counts[serial] += count
+		}
+	}
+	return counts, inWindow
+}
+
+var unknownFile = "<unknown>"
+
+func (r *reader) readFrame(_ int64) {
+	f := &Frame{ID: r.id()}
+	r.resolveString(r.id(), &f.Method, "frame referred to unknown method name string %d")
+	r.resolveString(r.id(), &f.Signature, "frame referred to unknown method signature string %d")
+	if sid := r.id(); sid > 0 {
+		r.resolveString(sid, &f.Filename, "frame referred to unknown filename string %d")
+	} else {
+		f.Filename = unknownFile
+	}
+	serial := r.u4()
+	c, ok := r.ClassBySerial[serial]
+	if !ok {
+		r.errorf("frame referred to unknown class serial %d", serial)
+	}
+	f.Class = c
+	f.Line = r.u4()
+	r.FrameByID[f.ID] = f
+}
+
+func (r *reader) readTrace(n int64) {
+	serial := r.u4()
+	threadSerial := r.u4()
+	numFrames := r.u4()
+	// Check the frame count against the record's length before allocating for it.
+	if n < 4+4+4 || int64(numFrames)*int64(r.IDSize) > n-(4+4+4) {
+		r.errorf("stack trace %d has %d frames, more than its record of %d bytes holds", serial, numFrames, n)
+	}
+	frames := make([]*Frame, numFrames)
+	for i := range frames {
+		id := r.id()
+		f, ok := r.FrameByID[id]
+		if !ok {
+			r.errorf("trace referred to unknown frame id %d", id)
+		}
+		frames[i] = f
+	}
+	t := &Trace{
+		Serial:       serial,
+		ThreadSerial: threadSerial,
+		Frames:       frames,
+	}
+	r.TraceBySerial[serial] = t
+}
+
+func (r *reader) basicSize(typ byte) int {
+	size := typeSize(typ, r.IDSize)
+	if size == 0 {
+		r.errorf("unexpected basic type %x", typ)
+	}
+	return size
+}
+
+// typeSize returns the size of a value of the basic type, or 0 if typ isn't one.
+func typeSize(typ byte, idSize int) int {
+	switch typ {
+	case 2: // object
+		return idSize
+	case 4: // boolean
+		return 1
+	case 5: // char
+		return 2
+	case 6: // float
+		return 4
+	case 7: // double
+		return 8
+	case 8: // byte
+		return 1
+	case 9: // short
+		return 2
+	case 10: // int
+		return 4
+	case 11: // long
+		return 8
+	}
+	return 0
+}
+
+// RootKindNames gives the name of each kind of GC root, by heap dump sub-tag.
+var RootKindNames = map[byte]string{
+	0xff: "unknown",
+	0x01: "JNI global",
+	0x02: "JNI local",
+	0x03: "Java frame",
+	0x04: "native stack",
+	0x05: "sticky class",
+	0x06: "thread block",
+	0x07: "monitor used",
+	0x08: "thread object",
+}
+
+// BasicTypeNames gives the Java name of each basic type (the types of fields and array elements), by the code
+// used in the dump.
+var BasicTypeNames = map[byte]string{
+	2:  "object",
+	4:  "boolean",
+	5:  "char",
+	6:  "float",
+	7:  "double",
+	8:  "byte",
+	9:  "short",
+	10: "int",
+	11: "long",
+}
+
+// A Root is a GC root.
+type Root struct {
+	ID   uint64 // of the rooted object
+	Kind byte   // heap dump sub-tag (see RootKindNames)
+}
+
+// addRoot records the GC root of the given kind for the object with the given ID. The roots will seed
+// reachability analysis.
+func (r *reader) addRoot(kind byte, id uint64) {
+	r.Roots = append(r.Roots, Root{ID: id, Kind: kind})
+	if _, ok := r.RootKinds[id]; !ok {
+		r.RootKinds[id] = kind
+	}
+}
+
+func (r *reader) className(classObjectID uint64) string {
+	if c, ok := r.ClassByID[classObjectID]; ok {
+		return c.Name
+	}
+	return "<unknown class>"
+}
+
+// ClassStats are the number of objects of a class and their total size.
+type ClassStats struct {
+	Count int64
+	Bytes int64
+}
+
+// addObject counts an object of the class with the given class object ID.
+func (r *reader) addObject(classObjectID uint64, size int64) {
+	stats, ok := r.ClassStats[classObjectID]
+	if !ok {
+		stats = new(ClassStats)
+		r.ClassStats[classObjectID] = stats
+	}
+	stats.Count++
+	stats.Bytes += size
+}
+
+// addPrimitiveArray counts a primitive array of the given element type.
+func (r *reader) addPrimitiveArray(typ byte, size int64) {
+	stats, ok := r.PrimitiveArrayStats[typ]
+	if !ok {
+		stats = new(ClassStats)
+		r.PrimitiveArrayStats[typ] = stats
+	}
+	stats.Count++
+	stats.Bytes += size
+}
+
+// A ClassTrace is a class and a stack trace at which objects of the class were allocated.
+type ClassTrace struct {
+	Class  string
+	Serial uint32
+}
+
+// addClassSize records an object of the named class allocated at the given stack trace, if the class matches
+// the class filter.
+func (r *reader) addClassSize(name string, traceSerial uint32, size int64) {
+	if !r.classFilter.MatchString(name) {
+		return
+	}
+	r.ClassTraceSizes[ClassTrace{name, traceSerial}] += size
+	r.ClassInstances[name]++
+}
+
+// checkLength rejects the contents of a heap dump sub-record that are longer than what remains of the heap
+// dump segment, which means the dump is corrupt.
+func (r *reader) checkLength(what string, length, remaining int64) {
+	if length > remaining {
+		r.errorf("%s of %d bytes is longer than the rest of its heap dump segment (%d bytes)", what, length, remaining)
+	}
+}
+
+func (r *reader) readHeapDumpSegment(remaining int64) int64 {
+	tag := r.u1()
+	r.SubTags[tag]++
+	idSize := int64(r.IDSize)
+	n := int64(1)
+	switch tag {
+	case 0xff: // ROOT UNKNOWN
+		r.addRoot(tag, r.id())
+		n += idSize
+	case 0x01: // ROOT JNI GLOBAL
+		r.addRoot(tag, r.id())
+		r.id()
+		n += idSize + idSize
+	case 0x02: // ROOT JNI LOCAL
+		r.addRoot(tag, r.id())
+		r.u4()
+		r.u4()
+		n += idSize + 4 + 4
+	case 0x03: // ROOT JAVA FRAME
+		r.addRoot(tag, r.id())
+		r.u4()
+		r.u4()
+		n += idSize + 4 + 4
+	case 0x04: // ROOT NATIVE STACK
+		r.addRoot(tag, r.id())
+		r.u4()
+		n += idSize + 4
+	case 0x05: // ROOT STICKY CLASS
+		r.addRoot(tag, r.id())
+		n += idSize
+	case 0x06: // ROOT THREAD BLOCK
+		r.addRoot(tag, r.id())
+		r.u4()
+		n += idSize + 4
+	case 0x07: // ROOT MONITOR USED
+		r.addRoot(tag, r.id())
+		n += idSize
+	case 0x08: // ROOT THREAD OBJECT
+		r.addRoot(tag, r.id())
+		r.u4()
+		r.u4()
+		n += idSize + 4 + 4
+	case 0x20: // CLASS DUMP
+		classObjectID := r.id()
+		c, ok := r.ClassByID[classObjectID]
+		if !ok {
+			r.errorf("class dump referred to bad class object id %d", classObjectID)
+		}
+		if _, ok := r.RootKinds[classObjectID]; ok {
+			r.RootClasses["java/lang/Class"]++
+		}
+		r.u4() // stack trace serial #
+		c.SuperID = r.id()
+		loaderID := r.id()
+		r.id() // signers object ID
+		r.id() // protection domain object ID
+		r.id() // reserved
+		r.id() // reserved
+		c.InstanceSize = r.u4()
+		n += idSize + 4 + idSize + idSize + idSize + idSize + idSize + idSize + 4
+
+		numCP := int(r.u2())
+		n += 2
+		refs := []uint64{c.SuperID, loaderID} // for the object graph
+		for i := 0; i < numCP; i++ {
+			r.u2() // constant pool index
+			typ := r.u1()
+			w := int64(r.basicSize(typ))
+			if typ == 2 { // object
+				refs = append(refs, r.id())
+			} else {
+				r.ignore(w)
+			}
+			n += 2 + 1 + w
+		}
+
+		numSF := int(r.u2())
+		n += 2
+		for i := 0; i < numSF; i++ {
+			r.id() // static field name string ID
+			typ := r.u1()
+			w := int64(r.basicSize(typ))
+			if typ == 2 { // object
+				refs = append(refs, r.id())
+			} else {
+				r.ignore(w)
+			}
+			n += idSize + 1 + w
+		}
+
+		numIF := int(r.u2())
+		n += 2
+		c.Fields = make([]Field, numIF)
+		for i := range c.Fields {
+			f := &c.Fields[i]
+			r.resolveString(r.id(), &f.Name, "field referred to unknown name string %d")
+			f.Type = r.u1()
+			r.basicSize(f.Type) // check it
+			n += idSize + 1
+		}
+		if r.graph != nil {
+			r.graph.add(classObjectID, classObject, classObjectID, 0, refs)
+		}
+	case 0x21: // INSTANCE DUMP
+		objectID := r.id()
+		traceSerial := r.u4()
+		classObjectID := r.id()
+		if _, ok := r.RootKinds[objectID]; ok {
+			r.RootClasses[r.className(classObjectID)]++
+		}
+		nn := int64(r.u4())
+		n += idSize + 4 + idSize + 4
+		r.checkLength("instance dump", nn, remaining-n)
+		size := nn + r.InstanceHeaderSize
+		switch {
+		case r.keepInstances:
+			data := make([]byte, nn)
+			if _, err := io.ReadFull(r, data); err != nil {
+				r.error(err)
+			}
+			r.Instances[objectID] = &Instance{ClassID: classObjectID, TraceSerial: traceSerial, Data: data}
+			if r.graph != nil {
+				r.addInstanceData(objectID, classObjectID, size, data)
+			}
+		case r.graph != nil:
+			r.addInstance(objectID, classObjectID, size, nn)
+		default:
+			r.ignore(nn)
+		}
+		n += nn
+
+		r.Total += size
+		r.InstanceOverhead += r.InstanceHeaderSize
+		r.TraceSizes[traceSerial] += size
+		r.addObject(classObjectID, size)
+		if r.classFilter != nil {
+			r.addClassSize(r.className(classObjectID), traceSerial, size)
+		}
+	case 0x22: // OBJECT ARRAY DUMP
+		objectID := r.id()
+		traceSerial := r.u4()
+		nn := int64(r.u4())
+		n += idSize + 4 + 4 + idSize // including the class object ID that follows
+		r.checkLength("object array dump", nn*idSize, remaining-n)
+		classObjectID := r.id()
+		if _, ok := r.RootKinds[objectID]; ok {
+			r.RootClasses[r.className(classObjectID)]++
+		}
+		var elements []uint64
+		for i := int64(0); i < nn; i++ {
+			id := r.id()
+			if r.graph != nil {
+				elements = append(elements, id)
+			}
+		}
+		n += nn * idSize
+
+		size := nn*idSize + r.ObjectArrayHeaderSize
+		if r.graph != nil {
+			r.graph.add(objectID, objectArrayObject, classObjectID, size, elements)
+		}
+		r.Total += size
+		r.ObjectArrayOverhead += r.ObjectArrayHeaderSize
+		r.TraceSizes[traceSerial] += size
+		r.addObject(classObjectID, size)
+		if r.classFilter != nil {
+			r.addClassSize(r.className(classObjectID), traceSerial, size)
+		}
+	case 0x23: // PRIMITIVE ARRAY DUMP
+		objectID := r.id()
+		traceSerial := r.u4()
+		nn := int64(r.u4())
+		typ := r.u1()
+		if _, ok := r.RootKinds[objectID]; ok {
+			r.RootClasses[BasicTypeNames[typ]+"[]"]++
+		}
+		w := int64(r.basicSize(typ))
+		n += idSize + 4 + 4 + 1
+		r.checkLength("primitive array dump", nn*w, remaining-n)
+		r.ignore(nn * w)
+		n += nn * w
+
+		size := nn*w + r.PrimitiveArrayHeaderSize
+		if r.graph != nil {
+			r.graph.add(objectID, primitiveArrayObject, uint64(typ), size, nil)
+		}
+		r.Total += size
+		r.PrimitiveArrayOverhead += r.PrimitiveArrayHeaderSize
+		r.TraceSizes[traceSerial] += size
+		r.addPrimitiveArray(typ, size)
+		if r.classFilter != nil {
+			r.addClassSize(BasicTypeNames[typ]+"[]", traceSerial, size)
+		}
+	default:
+		r.errorf("unknown sub-tag %x", tag)
+	}
+	return n
+}
+
+// RecordNames are the names of the record tags defined by the hprof binary format, including those that
+// aren't decoded.
+var RecordNames = map[byte]string{
+	0x01: "STRING IN UTF8",
+	0x02: "LOAD CLASS",
+	0x03: "UNLOAD CLASS",
+	0x04: "STACK FRAME",
+	0x05: "STACK TRACE",
+	0x06: "ALLOC SITES",
+	0x07: "HEAP SUMMARY",
+	0x0a: "START THREAD",
+	0x0b: "END THREAD",
+	0x0c: "HEAP DUMP",
+	0x0d: "CPU SAMPLES",
+	0x0e: "CONTROL SETTINGS",
+	0x1c: "HEAP DUMP SEGMENT",
+	0x2c: "HEAP DUMP END",
+}
+
+// secondHeader is the rest of a dump header following its first byte.
+const secondHeader = "AVA PROFILE "
+
+func (r *reader) readRecord() (done bool) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		if err == io.EOF {
+			return true
+		}
+		r.error(err)
+	}
+	tag := b[0]
+	if tag == 'J' {
+		// No record has this tag, but it starts the header of another dump.
+		if rest, _ := r.Peek(len(secondHeader)); string(rest) == secondHeader {
+			r.errorf("found another JAVA PROFILE header: several dumps were concatenated; split them first")
+		}
+	}
+	r.Tags[tag]++
+	ts := r.u4() // microseconds since the header timestamp
+	if ts != 0 {
+		r.HasTimestamps = true
+	}
+	r.recordTime = time.Duration(ts) * time.Microsecond
+	n := int64(r.u4())
+
+	switch tag {
+	case 0x01: // STRING IN UTF8
+		r.readString(n)
+	case 0x02: // LOAD CLASS
+		r.readClass(n)
+	case 0x03: // UNLOAD CLASS
+		r.unloadClass(n)
+	case 0x04: // STACK FRAME
+		r.readFrame(n)
+	case 0x05: // STACK TRACE
+		r.readTrace(n)
+	case 0x07: // HEAP SUMMARY
+		r.readHeapSummary(n)
+	case 0x0d: // CPU SAMPLES
+		r.readCPUSamples(n)
+	case 0x0c, 0x1c: // HEAP DUMP, HEAP DUMP SEGMENT
+		// A dump has either a single HEAP DUMP record or HEAP DUMP SEGMENTs followed by a HEAP DUMP END,
+		// with the same sub-records.
+		remaining := n
+		for remaining > 0 {
+			remaining -= r.readHeapDumpSegment(remaining)
+		}
+		if remaining < 0 {
+			r.errorf("heap dump segment overran its length by %d bytes", -remaining)
+		}
+	case 0x2c: // HEAP DUMP END
+		r.ignore(n) // empty
+	default:
+		r.ignore(n)
+	}
+
+	return false
+}
+
+func (r *reader) readHeader() {
+	s, err := r.ReadString(0)
+	if err != nil {
+		r.error(err)
+	}
+	if s != "JAVA PROFILE 1.0.2\x00" {
+		r.errorf("bad header string %q", s)
+	}
+	idSize := r.u4()
+	sizes, ok := idSizeHeaderSizes[int(idSize)]
+	if !ok {
+		r.errorf("only id sizes of 4 and 8 handled; got %d", idSize)
+	}
+	r.IDSize = int(idSize)
+	if r.InstanceHeaderSize == 0 {
+		r.InstanceHeaderSize = sizes.instance
+	}
+	if r.ObjectArrayHeaderSize == 0 {
+		r.ObjectArrayHeaderSize = sizes.objectArray
+	}
+	if r.PrimitiveArrayHeaderSize == 0 {
+		r.PrimitiveArrayHeaderSize = sizes.primitiveArray
+	}
+	// Skip the timestamp stuff for now.
+	r.u4()
+	r.u4()
+}
+
+func (r *reader) readAll() (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			re, ok := e.(readerError)
+			if !ok {
+				panic(e)
+			}
+			err = re.err
+		}
+	}()
+
+	r.readHeader()
+	for !r.readRecord() {
+	}
+	r.resolvePending()
+	if r.graph != nil {
+		r.finishGraph()
+	}
+	return nil
+}
+
+// A StackSize is an amount (such as bytes allocated, or samples) attributed to a stack trace.
+type StackSize struct {
+	Serial uint32
+	Size   int64
+	Frames []*Frame // innermost first; nil if the dump doesn't have the trace
+}
+
+// TopStacks returns the n stack traces with the largest sizes in sizes (such as h.TraceSizes, or counts from
+// CPUSampleCounts), largest first.
+func (h *Heap) TopStacks(sizes map[uint32]int64, n int) []StackSize {
+	var stacks []StackSize
+	for _, ss := range topN(sizes, n) {
+		s := StackSize{Serial: ss.serial, Size: ss.size}
+		if t, ok := h.TraceBySerial[ss.serial]; ok {
+			s.Frames = t.Frames
+		}
+		stacks = append(stacks, s)
+	}
+	return stacks
+}
+
+func topN(m map[uint32]int64, n int) []serialSize {
+	var h serialSizes
+	for serial, size := range m {
+		ss := serialSize{serial: serial, size: size}
+		if len(h) < n {
+			heap.Push(&h, ss)
+			continue
+		}
+		if ss.size > h[0].size {
+			h[0] = ss
+			heap.Fix(&h, 0)
+		}
+	}
+	// Pop the smallest first to fill the result from the end.
+	top := make([]serialSize, len(h))
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = heap.Pop(&h).(serialSize)
+	}
+	return top
+}
+
+type serialSize struct {
+	serial uint32
+	size   int64
+}
+
+type serialSizes []serialSize
+
+func (s *serialSizes) Len() int           { return len(*s) }
+func (s *serialSizes) Less(i, j int) bool { return (*s)[i].size < (*s)[j].size }
+func (s *serialSizes) Swap(i, j int)      { (*s)[i], (*s)[j] = (*s)[j], (*s)[i] }
+func (s *serialSizes) Push(x interface{}) { *s = append(*s, x.(serialSize)) }
+func (s *serialSizes) Pop() interface{} {
+	n := len(*s)
+	v := (*s)[n-1]
+	*s = (*s)[:n-1]
+	return v
+}
@@ -0,0 +1,306 @@
+package hprof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A dump builds a heap dump, or the body of one of its records, for tests.
+type dump struct {
+	bytes.Buffer
+	idSize int
+}
+
+// newDump starts a dump with the given id size.
+func newDump(idSize int) *dump {
+	d := &dump{idSize: idSize}
+	d.WriteString("JAVA PROFILE 1.0.2\x00")
+	d.u4(uint32(idSize))
+	d.u4(0) // timestamp
+	d.u4(0)
+	return d
+}
+
+// body returns an empty record body for the dump.
+func (d *dump) body() *dump { return &dump{idSize: d.idSize} }
+
+func (d *dump) u1(v byte) { d.WriteByte(v) }
+
+func (d *dump) u2(v uint16) { binary.Write(d, binary.BigEndian, v) }
+
+func (d *dump) u4(v uint32) { binary.Write(d, binary.BigEndian, v) }
+
+func (d *dump) u8(v uint64) { binary.Write(d, binary.BigEndian, v) }
+
+func (d *dump) id(v uint64) {
+	if d.idSize == 4 {
+		d.u4(uint32(v))
+	} else {
+		d.u8(v)
+	}
+}
+
+// record appends a record with the given tag and body.
+func (d *dump) record(tag byte, body *dump) {
+	d.recordLength(tag, uint32(body.Len()), body)
+}
+
+// recordLength appends a record with the given tag and body, but with the given length in its header.
+func (d *dump) recordLength(tag byte, length uint32, body *dump) {
+	d.u1(tag)
+	d.u4(0) // timestamp
+	d.u4(length)
+	d.Write(body.Bytes())
+}
+
+// str appends a STRING IN UTF8 record.
+func (d *dump) str(id uint64, s string) {
+	b := d.body()
+	b.id(id)
+	b.WriteString(s)
+	d.record(0x01, b)
+}
+
+// parseError parses the dump, which should fail, and returns the error.
+func parseError(t *testing.T, d *dump) error {
+	t.Helper()
+	_, err := Parse(bytes.NewReader(d.Bytes()))
+	if err == nil {
+		t.Fatal("parsed a corrupt dump without error")
+	}
+	return err
+}
+
+// analyzeFile analyzes the named dump under testdata.
+func analyzeFile(t *testing.T, name string, opts Options) *Result {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	res, err := Analyze(f, opts)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	return res
+}
+
+func TestAnalyze(t *testing.T) {
+	res := analyzeFile(t, "heap.hprof", Options{})
+	// Two instances (16+12 bytes), an array of two objects (24+16), and a byte[10] (24+10).
+	if res.Total != 130 {
+		t.Errorf("got total %d; want 130", res.Total)
+	}
+	if res.Strings != 9 || res.Classes != 2 || res.UnloadedClasses != 1 || res.StackTraces != 2 {
+		t.Errorf("got %d strings, %d classes, %d unloaded, %d traces; want 9, 2, 1, 2",
+			res.Strings, res.Classes, res.UnloadedClasses, res.StackTraces)
+	}
+	if got := res.Heap.TraceSizes[7]; got != 68 {
+		t.Errorf("got %d bytes for trace 7; want 68", got)
+	}
+}
+
+func TestAnalyzeGzip(t *testing.T) {
+	want := analyzeFile(t, "heap.hprof", Options{})
+	got := analyzeFile(t, "heap.hprof.gz", Options{})
+	got.Heap, want.Heap = nil, nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("gzipped dump analyzed as\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestShortString(t *testing.T) {
+	d := newDump(8)
+	b := d.body()
+	b.u4(1) // only half an id
+	d.record(0x01, b)
+	err := parseError(t, d)
+	if want := "too short"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q; want one containing %q", err, want)
+	}
+}
+
+func TestTraceFrameCount(t *testing.T) {
+	for _, idSize := range []int{4, 8} {
+		d := newDump(idSize)
+		b := d.body()
+		b.u4(1)       // serial
+		b.u4(1)       // thread serial
+		b.u4(1 << 30) // number of frames, without any following
+		d.record(0x05, b)
+		err := parseError(t, d)
+		if want := "more than its record of 12 bytes holds"; !strings.Contains(err.Error(), want) {
+			t.Errorf("id size %d: got error %q; want one containing %q", idSize, err, want)
+		}
+	}
+}
+
+func TestSubRecordNearOverflow(t *testing.T) {
+	// Each sub-record claims almost all of a segment of the maximum length. Only once its own header is
+	// subtracted from the segment's length is it too long.
+	for _, tt := range []struct {
+		name string
+		sub  func(b *dump)
+	}{
+		{"instance dump", func(b *dump) {
+			b.u1(0x21)
+			b.id(1)
+			b.u4(0)
+			b.id(2)
+			b.u4(0xffffffff - 20)
+		}},
+		{"object array dump", func(b *dump) {
+			b.u1(0x22)
+			b.id(1)
+			b.u4(0)
+			b.u4((0xffffffff - 20) / 8)
+			b.id(2)
+		}},
+		{"primitive array dump", func(b *dump) {
+			b.u1(0x23)
+			b.id(1)
+			b.u4(0)
+			b.u4(0xffffffff - 17) // one byte more than the rest of the segment
+			b.u1(8)               // byte
+		}},
+	} {
+		d := newDump(8)
+		b := d.body()
+		tt.sub(b)
+		d.recordLength(0x1c, 0xffffffff, b)
+		err := parseError(t, d)
+		want := tt.name + " of "
+		if !strings.Contains(err.Error(), want) || !strings.Contains(err.Error(), "longer than the rest") {
+			t.Errorf("%s: got error %q; want a length error", tt.name, err)
+		}
+	}
+}
+
+func TestCPUSamplesCount(t *testing.T) {
+	d := newDump(8)
+	b := d.body()
+	b.u4(10)         // total
+	b.u4(0xffffffff) // number of traces, without any following
+	d.record(0x0d, b)
+	err := parseError(t, d)
+	if want := "more than its 8 bytes hold"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q; want one containing %q", err, want)
+	}
+}
+
+func TestAnalyzeIDSize4(t *testing.T) {
+	// The same objects as in heap.hprof, with 4-byte ids.
+	res := analyzeFile(t, "heap4.hprof", Options{})
+	h := res.Heap
+	if h.IDSize != 4 {
+		t.Fatalf("got id size %d; want 4", h.IDSize)
+	}
+	// The defaults for 4-byte ids are the header sizes of a 32-bit VM.
+	if h.InstanceHeaderSize != 8 || h.ObjectArrayHeaderSize != 12 || h.PrimitiveArrayHeaderSize != 12 {
+		t.Errorf("got header sizes %d, %d, %d; want 8, 12, 12",
+			h.InstanceHeaderSize, h.ObjectArrayHeaderSize, h.PrimitiveArrayHeaderSize)
+	}
+	// Two instances (8+8 bytes), an array of two objects (12+8), and a byte[10] (12+10).
+	if res.Total != 74 {
+		t.Errorf("got total %d; want 74", res.Total)
+	}
+	if res.InstanceOverhead != 16 || res.ObjectArrayOverhead != 12 || res.PrimitiveArrayOverhead != 12 {
+		t.Errorf("got overheads %d, %d, %d; want 16, 12, 12",
+			res.InstanceOverhead, res.ObjectArrayOverhead, res.PrimitiveArrayOverhead)
+	}
+	if got := h.TraceSizes[7]; got != 36 {
+		t.Errorf("got %d bytes for trace 7; want 36", got)
+	}
+
+	// Explicit header sizes override the defaults.
+	res = analyzeFile(t, "heap4.hprof", Options{InstanceHeaderSize: 12})
+	if res.Heap.InstanceHeaderSize != 12 || res.Heap.ObjectArrayHeaderSize != 12 || res.Total != 82 {
+		t.Errorf("with an instance header of 12: got header sizes %d, %d and total %d; want 12, 12, 82",
+			res.Heap.InstanceHeaderSize, res.Heap.ObjectArrayHeaderSize, res.Total)
+	}
+}
+
+func TestHeapDumpRecord(t *testing.T) {
+	// heap0c.hprof has the sub-records of heap.hprof's HEAP DUMP SEGMENT (followed by a HEAP DUMP END) in a
+	// single HEAP DUMP record.
+	want := analyzeFile(t, "heap.hprof", Options{ObjectGraph: true})
+	got := analyzeFile(t, "heap0c.hprof", Options{ObjectGraph: true})
+	if got.Tags[0x0c] != 1 || got.Tags[0x1c] != 0 || got.Tags[0x2c] != 0 {
+		t.Errorf("got %d HEAP DUMP, %d HEAP DUMP SEGMENT, and %d HEAP DUMP END records; want 1, 0, 0",
+			got.Tags[0x0c], got.Tags[0x1c], got.Tags[0x2c])
+	}
+	gotTree, err := got.Heap.Dominators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTree, err := want.Heap.Dominators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotTree.Top(10), wantTree.Top(10)) {
+		t.Errorf("got retained objects %+v; want %+v", gotTree.Top(10), wantTree.Top(10))
+	}
+	got.Heap, want.Heap = nil, nil
+	got.Tags, want.Tags = [256]int{}, [256]int{}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("HEAP DUMP record analyzed as\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestForwardStringReference(t *testing.T) {
+	// forward.hprof is heap.hprof with the string "run" defined after the frame that refers to it.
+	res := analyzeFile(t, "forward.hprof", Options{})
+	if got := res.Heap.FrameByID[501].Method; got != "run" {
+		t.Errorf("got method %q for frame 501; want \"run\"", got)
+	}
+
+	d := newDump(8)
+	d.str(1, "Foo")
+	d.loadClass(1, 100, 1)
+	b := d.body()
+	b.id(500) // frame ID
+	b.id(2)   // method name, never defined
+	b.id(0)   // signature, never defined either
+	b.id(0)   // no filename
+	b.u4(1)   // class serial
+	b.u4(10)  // line
+	d.record(0x04, b)
+	err := parseError(t, d)
+	if want := "frame referred to unknown method name string 2"; err.Error() != want {
+		t.Errorf("got error %q; want %q", err, want)
+	}
+}
+
+func TestConcatenatedDumps(t *testing.T) {
+	// concatenated.hprof is heap.hprof followed by heap4.hprof.
+	f, err := os.Open(filepath.Join("testdata", "concatenated.hprof"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = Parse(f)
+	if err == nil || !strings.Contains(err.Error(), "several dumps were concatenated") {
+		t.Fatalf("got error %v; want one about concatenated dumps", err)
+	}
+}
+
+func TestAnalyzeErrorWarnings(t *testing.T) {
+	d := newDump(8)
+	d.str(1, "bad \xff string")
+	b := d.body()
+	b.u4(1)
+	d.recordLength(0x02, 100, b) // truncated LOAD CLASS
+	res, err := Analyze(bytes.NewReader(d.Bytes()), Options{ValidateUTF8: true})
+	if err == nil {
+		t.Fatal("analyzed a truncated dump without error")
+	}
+	if res == nil || len(res.Warnings) != 1 || res.Warnings[0].Category != "invalid-utf8" {
+		t.Fatalf("got result %+v; want one with the invalid-utf8 warning found before the error", res)
+	}
+}
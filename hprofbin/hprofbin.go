@@ -1,561 +1,623 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"container/heap"
-	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/cespare/hprofviz/hprof"
+	"github.com/cespare/hprofviz/internal/infile"
 	"github.com/dustin/go-humanize"
 )
 
 // Experiment with hprof binary format.
 
-type reader struct {
-	*bufio.Reader
-
-	idSize  int
-	scratch [8]byte
-
-	strings       map[uint64]string
-	classByID     map[uint64]*class
-	classBySerial map[uint32]*class
-	frameByID     map[uint64]*frame
-	traceBySerial map[uint32]*trace
-
-	total                  int64
-	instanceOverhead       int64
-	objectArrayOverhead    int64
-	primitiveArrayOverhead int64
-	traceSizes             map[uint32]int64
+var (
+	compareToJVMTotal = flag.Bool("compare-to-jvm-total", false,
+		"Compare the computed total size against the live bytes reported by the JVM")
+	maxDiscrepancy = flag.Float64("max-discrepancy", 0.05,
+		"Flag computed totals deviating from the JVM-reported total by more than this ratio")
+	strict = flag.Bool("strict", false, "Treat problems found by sanity checks as fatal errors")
+	since  = flag.Duration("since", 0, "Only include CPU sample records at least this far after the dump start")
+	until  = flag.Duration("until", 0,
+		"Only include CPU sample records at most this far after the dump start (0 means no limit)")
+	validateUTF8 = flag.Bool("validate-utf8", false,
+		"Check that string records are valid UTF-8, replacing invalid sequences (or failing, with -strict)")
+	quiet                = flag.Bool("quiet", false, "Suppress notes and warnings about the analysis")
+	topAllocatingMethods = flag.Bool("top-allocating-methods", false,
+		"Print the methods that allocated the most bytes (attributing each stack's bytes to its leaf frame)")
+	topCumulativeMethods = flag.Bool("top-cumulative-methods", false,
+		"Print the methods with the most bytes allocated in or below them (counting each stack toward all its methods)")
+	collapseFrames = flag.Bool("collapse-frames", false,
+		"When printing stacks, print runs of the same frame (from recursion) once, with a count")
+	instanceHeader = flag.Int64("instance-header", hprof.DefaultInstanceHeaderSize,
+		"Bytes of header counted for each object instance (the defaults suit 64-bit OpenJDK 8, or a 32-bit VM "+
+			"for dumps with 4-byte ids)")
+	objectArrayHeader = flag.Int64("object-array-header", hprof.DefaultObjectArrayHeaderSize,
+		"Bytes of header counted for each object array")
+	primitiveArrayHeader = flag.Int64("primitive-array-header", hprof.DefaultPrimitiveArrayHeaderSize,
+		"Bytes of header counted for each primitive array")
+	oops = flag.String("oops", "",
+		"Use the header sizes of 64-bit HotSpot with (compressed) or without (uncompressed) compressed oops, "+
+			"overriding -instance-header, -object-array-header, and -primitive-array-header (by default, the "+
+			"header sizes are chosen by the dump's id size)")
+	verifyDump = flag.Bool("verify", false,
+		"Only check the dump's integrity (the total against the JVM's, within -max-discrepancy, and the record "+
+			"types), printing PASS or FAIL and exiting non-zero on failure")
+	warningsFile = flag.String("warnings-file", "",
+		"Write warnings to this file as JSON lines (with offset, category, and detail) instead of summarizing them")
+	classPattern = flag.String("class", "",
+		"Print the stacks that allocated the most bytes of classes matching this regex")
+	objectID = flag.String("object", "",
+		"Only print the class and field values of the instance with this object ID (such as 0x7f0001234)")
+	retainedTop = flag.Int("retained", 0,
+		"Compute the retained sizes of the objects reachable from the GC roots (from their dominator tree) and "+
+			"print the objects retaining the most bytes, this many of them (this needs much more memory)")
+	histogramTop = flag.Int("histogram", 10,
+		"Print the number and size of the objects of the classes using the most bytes, this many of them, "+
+			"like jmap -histo (0 for none)")
+)
 
-	tags    [256]int
-	subTags [256]int
+// oopsHeaderSizes are the header sizes of 64-bit HotSpot (JDK 8 and later) with and without compressed oops,
+// as -oops selects, from the object layouts that JOL reports. Compressed oops
+// (-XX:+UseCompressedOops) are the default for heaps under 32GB; they also enable compressed class pointers,
+// which shrink the class word of each header from 8 bytes to 4:
+//
+//	                  instance  array
+//	compressed oops   12        16 (8 mark + 4 class + 4 length)
+//	uncompressed      16        24 (8 mark + 8 class + 4 length, padded to 8 bytes)
+var oopsHeaderSizes = map[string]hprof.Options{
+	"compressed":   {InstanceHeaderSize: 12, ObjectArrayHeaderSize: 16, PrimitiveArrayHeaderSize: 16},
+	"uncompressed": {InstanceHeaderSize: 16, ObjectArrayHeaderSize: 24, PrimitiveArrayHeaderSize: 24},
 }
 
-func newReader(r io.Reader) *reader {
-	return &reader{
-		Reader:        bufio.NewReader(r),
-		strings:       make(map[uint64]string),
-		classByID:     make(map[uint64]*class),
-		classBySerial: make(map[uint32]*class),
-		frameByID:     make(map[uint64]*frame),
-		traceBySerial: make(map[uint32]*trace),
-		traceSizes:    make(map[uint32]int64),
+// headerSizeOptions returns the Options with the header sizes given by -oops or by the header size flags in
+// set (the flags given on the command line). Header sizes that aren't given are left zero, for Analyze to
+// choose according to the dump's id size.
+func headerSizeOptions(set map[string]bool) (hprof.Options, error) {
+	var opts hprof.Options
+	if *instanceHeader < 0 || *objectArrayHeader < 0 || *primitiveArrayHeader < 0 {
+		return opts, errors.New("header sizes cannot be negative")
 	}
+	if *oops != "" {
+		sizes, ok := oopsHeaderSizes[*oops]
+		if !ok {
+			return opts, fmt.Errorf("bad -oops %q: must be compressed or uncompressed", *oops)
+		}
+		if set["instance-header"] || set["object-array-header"] || set["primitive-array-header"] {
+			notef("-oops overrides the header size flags")
+		}
+		return sizes, nil
+	}
+	if set["instance-header"] {
+		opts.InstanceHeaderSize = *instanceHeader
+	}
+	if set["object-array-header"] {
+		opts.ObjectArrayHeaderSize = *objectArrayHeader
+	}
+	if set["primitive-array-header"] {
+		opts.PrimitiveArrayHeaderSize = *primitiveArrayHeader
+	}
+	return opts, nil
 }
 
-// TODO: Compute/guess overhead more accurately.
-// These header sizes are correct for 64-bit OpenJDK 8, empirically.
-const (
-	instanceHeaderSize       = 16
-	objectArrayHeaderSize    = 24
-	primitiveArrayHeaderSize = 24
-)
-
-type readerError struct {
-	err error
-}
-
-func (r *reader) error(err error) {
-	panic(readerError{err})
+// writeWarnings writes warnings as JSON lines to the named file.
+func writeWarnings(name string, warnings []hprof.Warning) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, w := range warnings {
+		if err := enc.Encode(w); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
 }
 
-func (r *reader) errorf(format string, args ...interface{}) {
-	r.error(fmt.Errorf(format, args...))
+// summarizeWarnings prints the number of warnings in each category to stderr, with the first of each.
+func summarizeWarnings(warnings []hprof.Warning) {
+	if len(warnings) == 0 {
+		return
+	}
+	first := make(map[string]hprof.Warning)
+	counts := make(map[string]int)
+	var categories []string
+	for _, w := range warnings {
+		if counts[w.Category] == 0 {
+			first[w.Category] = w
+			categories = append(categories, w.Category)
+		}
+		counts[w.Category]++
+	}
+	fmt.Fprintf(os.Stderr, "%d warnings (use -warnings-file to list them all):\n", len(warnings))
+	for _, c := range categories {
+		w := first[c]
+		fmt.Fprintf(os.Stderr, "  %s: %d, such as: %s", c, counts[c], w.Detail)
+		if w.Offset >= 0 {
+			fmt.Fprintf(os.Stderr, " (at offset %d)", w.Offset)
+		}
+		fmt.Fprintln(os.Stderr)
+	}
 }
 
-func (r *reader) u1() byte {
-	b := r.scratch[:1]
-	if _, err := io.ReadFull(r, b); err != nil {
-		r.error(err)
+// formatStack formats the frames of a stack trace, one per line.
+func formatStack(ss hprof.StackSize) string {
+	if ss.Frames == nil {
+		return fmt.Sprintf("trace %d not in dump\n", ss.Serial)
+	}
+	frames := ss.Frames
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "trace %d\n", ss.Serial)
+	for i := 0; i < len(frames); i++ {
+		frame := frames[i]
+		fmt.Fprintf(&buf, "  %s [%s] | %s:%d",
+			frame.Method, frame.Signature, frame.Filename, frame.Line)
+		if *collapseFrames {
+			// Print a run of the same frame (from recursion) once, with a count.
+			n := 1
+			for i+1 < len(frames) && frames[i+1] == frame {
+				i++
+				n++
+			}
+			if n > 1 {
+				fmt.Fprintf(&buf, " (x%d)", n)
+			}
+		}
+		buf.WriteByte('\n')
 	}
-	return b[0]
+	return buf.String()
 }
 
-func (r *reader) u2() uint16 {
-	b := r.scratch[:2]
-	if _, err := io.ReadFull(r, b); err != nil {
-		r.error(err)
+func printCPUSamples(h *hprof.Heap) {
+	counts, inWindow := h.CPUSampleCounts(*since, *until)
+	fmt.Println()
+	if *since > 0 || *until > 0 {
+		if h.HasTimestamps {
+			fmt.Printf("%d/%d CPU SAMPLES records in the time window\n", inWindow, len(h.CPUSamples))
+		} else {
+			notef("no record timestamps in dump; ignoring -since/-until")
+		}
+	}
+	fmt.Println("top 10 sampled stacks:")
+	for _, ss := range h.TopStacks(counts, 10) {
+		fmt.Printf("%d\t%d samples\n", ss.Serial, ss.Size)
+		fmt.Println(formatStack(ss))
 	}
-	return binary.BigEndian.Uint16(b)
 }
 
-func (r *reader) u4() uint32 {
-	b := r.scratch[:4]
-	if _, err := io.ReadFull(r, b); err != nil {
-		r.error(err)
+func printHistogram(classes []hprof.ClassSize, n int) {
+	fmt.Printf("top %d classes by bytes (of %d):\n", n, len(classes))
+	if len(classes) > n {
+		classes = classes[:n]
+	}
+	for _, c := range classes {
+		fmt.Printf("  %s\t%d instances\t%d\t(%s)\n", c.Name, c.Instances, c.Size, humanize.Bytes(uint64(c.Size)))
 	}
-	return binary.BigEndian.Uint32(b)
 }
 
-func (r *reader) u8() uint64 {
-	b := r.scratch[:8]
-	if _, err := io.ReadFull(r, b); err != nil {
-		r.error(err)
+// printObject prints the class and field values of the instance with the given object ID.
+func printObject(h *hprof.Heap, id uint64) error {
+	fields, err := h.Fields(id)
+	if err != nil {
+		return err
+	}
+	inst := h.Instances[id]
+	fmt.Printf("object %#x: %s (%d bytes of fields)\n", id, h.ClassByID[inst.ClassID].Name, len(inst.Data))
+	for _, f := range fields {
+		var value string
+		switch v := f.Value.(type) {
+		case uint64: // object ID
+			value = "null"
+			if v != 0 {
+				value = fmt.Sprintf("%#x", v)
+			}
+		case uint16: // char
+			value = strconv.QuoteRune(rune(v))
+		default:
+			value = fmt.Sprint(v)
+		}
+		fmt.Printf("  %s.%s\t%s\t%s\n", f.Class, f.Name, hprof.BasicTypeNames[f.Type], value)
 	}
-	return binary.BigEndian.Uint64(b)
+	return nil
 }
 
-func (r *reader) id() uint64 {
-	return r.u8()
+func printClassStacks(res *hprof.Result) {
+	fmt.Println()
+	if len(res.ClassHistogram) == 0 {
+		fmt.Printf("no objects of classes matching %q\n", *classPattern)
+		return
+	}
+	fmt.Printf("classes matching %q:\n", *classPattern)
+	for _, c := range res.ClassHistogram {
+		fmt.Printf("  %s\t%d instances\t%d\t(%s)\n", c.Name, c.Instances, c.Size, humanize.Bytes(uint64(c.Size)))
+	}
+	traceSizes := make(map[uint32]int64)
+	for ct, size := range res.Heap.ClassTraceSizes {
+		traceSizes[ct.Serial] += size
+	}
+	fmt.Println("top 10 stacks allocating them:")
+	for _, ss := range res.Heap.TopStacks(traceSizes, 10) {
+		fmt.Printf("%d\t%d\t(%s)\n", ss.Serial, ss.Size, humanize.Bytes(uint64(ss.Size)))
+		fmt.Println(formatStack(ss))
+	}
 }
 
-func (r *reader) bytes(n int) []byte {
-	var b []byte
-	if n <= len(r.scratch) {
-		b = r.scratch[:n]
-	} else {
-		b = make([]byte, n)
+func printRoots(h *hprof.Heap) {
+	fmt.Println()
+	fmt.Printf("%d GC roots (%d objects):\n", len(h.Roots), len(h.RootKinds))
+	var kinds [256]int
+	for _, root := range h.Roots {
+		kinds[root.Kind]++
+	}
+	for kind, c := range kinds {
+		if c > 0 {
+			fmt.Printf("  %s\t%d\n", hprof.RootKindNames[byte(kind)], c)
+		}
+	}
+	type classCount struct {
+		name  string
+		count int
+	}
+	var classes []classCount
+	for name, count := range h.RootClasses {
+		classes = append(classes, classCount{name, count})
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if classes[i].count != classes[j].count {
+			return classes[i].count > classes[j].count
+		}
+		return classes[i].name < classes[j].name
+	})
+	if len(classes) > 10 {
+		classes = classes[:10]
 	}
-	if _, err := io.ReadFull(r, b); err != nil {
-		r.error(err)
+	fmt.Println("top 10 classes of rooted objects:")
+	for _, c := range classes {
+		fmt.Printf("  %d\t%s\n", c.count, c.name)
 	}
-	return b
 }
 
-func (r *reader) ignore(n int) {
-	if _, err := io.CopyN(ioutil.Discard, r, int64(n)); err != nil {
-		r.error(err)
+func printRetained(h *hprof.Heap, n int) error {
+	t, err := h.Dominators()
+	if err != nil {
+		return err
+	}
+	fmt.Println()
+	fmt.Printf("%d objects (%s) reachable from the GC roots\n", t.Reachable, humanize.Bytes(uint64(t.ReachableBytes)))
+	fmt.Printf("top %d objects by retained bytes:\n", n)
+	for _, o := range t.Top(n) {
+		fmt.Printf("  %#x\t%s\t%d\t(%s)\tshallow %d\n",
+			o.ID, o.Class, o.Retained, humanize.Bytes(uint64(o.Retained)), o.Size)
 	}
+	return nil
 }
 
-type class struct {
-	serial           uint32
-	id               uint64
-	stackTraceSerial uint32
-	name             string
+type methodSize struct {
+	method string
+	size   int64
 }
 
-type frame struct {
-	id         uint64
-	methodName string
-	methodSig  string
-	filename   string
-	class      *class
-	lineNum    uint32
+// allocatingMethods attributes the bytes allocated by each stack trace to the trace's leaf frame (the
+// allocating method) and returns the methods sorted by descending size.
+func allocatingMethods(h *hprof.Heap) []methodSize {
+	return methodSizes(h, false)
 }
 
-type trace struct {
-	serial       uint32
-	threadSerial uint32
-	frames       []*frame
+// cumulativeMethods attributes the bytes allocated by each stack trace to every method in the trace, like
+// the cumulative counts of the CPU graph, and returns the methods sorted by descending size. A method that
+// occurs several times in one stack (through recursion) is only counted once for it.
+func cumulativeMethods(h *hprof.Heap) []methodSize {
+	return methodSizes(h, true)
 }
 
-func (t *trace) String() string {
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "trace %d\n", t.serial)
-	for _, frame := range t.frames {
-		fmt.Fprintf(&buf, "  %s [%s] | %s:%d\n",
-			frame.methodName, frame.methodSig, frame.filename, frame.lineNum)
+func methodSizes(h *hprof.Heap, cumulative bool) []methodSize {
+	sizes := make(map[string]int64)
+	for serial, size := range h.TraceSizes {
+		t, ok := h.TraceBySerial[serial]
+		if !ok || len(t.Frames) == 0 {
+			sizes["<unknown>"] += size
+			continue
+		}
+		frames := t.Frames[:1]
+		if cumulative {
+			frames = t.Frames
+		}
+		seen := make(map[string]bool)
+		for _, f := range frames {
+			method := f.Class.Name + "." + f.Method + f.Signature
+			if !seen[method] {
+				sizes[method] += size
+				seen[method] = true
+			}
+		}
 	}
-	return buf.String()
+	methods := make([]methodSize, 0, len(sizes))
+	for method, size := range sizes {
+		methods = append(methods, methodSize{method, size})
+	}
+	sort.Slice(methods, func(i, j int) bool {
+		if methods[i].size != methods[j].size {
+			return methods[i].size > methods[j].size
+		}
+		return methods[i].method < methods[j].method
+	})
+	return methods
 }
 
-func (r *reader) readString(n int) {
-	id := r.id()
-	s := string(r.bytes(n - r.idSize))
-	r.strings[id] = s
+// notef prints a note or warning about the analysis (as opposed to its results), unless -quiet is given.
+func notef(format string, args ...interface{}) {
+	if !*quiet {
+		fmt.Printf(format+"\n", args...)
+	}
 }
 
-func (r *reader) readClass(n int) {
-	serial := r.u4()
-	id := r.id()
-	stackTraceSerial := r.u4()
-	nameID := r.id()
-	name, ok := r.strings[nameID]
-	if !ok {
-		r.errorf("class referred to unknown name %d", nameID)
-	}
-	c := &class{
-		serial:           serial,
-		id:               id,
-		stackTraceSerial: stackTraceSerial,
-		name:             name,
-	}
-	r.classByID[id] = c
-	r.classBySerial[serial] = c
+// compareToJVM checks the computed total against the live bytes in the JVM's HEAP SUMMARY. A large
+// discrepancy usually indicates a parsing bug or an unhandled record type.
+func compareToJVM(res *hprof.Result) {
+	hs := res.HeapSummary
+	if hs == nil {
+		notef("no HEAP SUMMARY record; cannot compare against the JVM total")
+		return
+	}
+	if hs.LiveBytes == 0 {
+		notef("JVM reported 0 live bytes; cannot compare against the JVM total")
+		return
+	}
+	ratio := float64(res.Total) / float64(hs.LiveBytes)
+	fmt.Printf("computed/JVM live bytes: %d/%d (ratio %.3f)\n", res.Total, hs.LiveBytes, ratio)
+	if math.Abs(ratio-1) <= *maxDiscrepancy {
+		return
+	}
+	msg := fmt.Sprintf("computed total deviates from the JVM-reported total by %.1f%% (more than %.1f%%)",
+		100*math.Abs(ratio-1), 100**maxDiscrepancy)
+	if *strict {
+		log.Fatal(msg)
+	}
+	res.Warnings = append(res.Warnings, hprof.Warning{Offset: -1, Category: "total-mismatch", Detail: msg})
 }
 
-var unknownFile = "<unknown>"
-
-func (r *reader) readFrame(_ int) {
-	id := r.id()
-	sid := r.id()
-	methodName, ok := r.strings[sid]
-	if !ok {
-		r.errorf("frame referred to unknown method name string %d", sid)
-	}
-	sid = r.id()
-	methodSig, ok := r.strings[sid]
-	if !ok {
-		r.errorf("frame referred to unknown method signature string %d", sid)
-	}
-	sid = r.id()
-	filename := unknownFile
-	if sid > 0 {
-		filename, ok = r.strings[sid]
-		if !ok {
-			r.errorf("frame referred to unknown filename string %d", sid)
+// verify checks the integrity of the dump analyzed as res (or whose analysis failed with readErr, if non-nil)
+// and prints the result of each check. It reports whether all the checks passed.
+func verify(res *hprof.Result, readErr error) bool {
+	ok := true
+	check := func(name string, pass bool, format string, args ...interface{}) {
+		result := "PASS"
+		if !pass {
+			result = "FAIL"
+			ok = false
 		}
+		fmt.Printf("%s\t%s: %s\n", result, name, fmt.Sprintf(format, args...))
 	}
-	serial := r.u4()
-	c, ok := r.classBySerial[serial]
-	if !ok {
-		r.errorf("frame referred to unknown class serial %d", serial)
-	}
-	lineNum := r.u4()
-	f := &frame{
-		id:         id,
-		methodName: methodName,
-		methodSig:  methodSig,
-		filename:   filename,
-		class:      c,
-		lineNum:    lineNum,
-	}
-	r.frameByID[id] = f
-}
+	if readErr != nil {
+		check("read", false, "%s", readErr)
+		return false
+	}
+	check("read", true, "%d records", sumCounts(res.Tags[:]))
 
-func (r *reader) readTrace(_ int) {
-	serial := r.u4()
-	threadSerial := r.u4()
-	n := int(r.u4())
-	frames := make([]*frame, n)
-	for i := range frames {
-		id := r.id()
-		f, ok := r.frameByID[id]
-		if !ok {
-			r.errorf("trace referred to unknown frame id %d", id)
+	var unknown []string
+	for tag, c := range res.Tags {
+		if _, known := hprof.RecordNames[byte(tag)]; c > 0 && !known {
+			unknown = append(unknown, fmt.Sprintf("%#x (%d)", tag, c))
 		}
-		frames[i] = f
 	}
-	t := &trace{
-		serial:       serial,
-		threadSerial: threadSerial,
-		frames:       frames,
+	if len(unknown) > 0 {
+		check("record types", false, "unknown tags %s", strings.Join(unknown, ", "))
+	} else {
+		check("record types", true, "all known")
 	}
-	r.traceBySerial[serial] = t
-}
 
-func (r *reader) basicSize(typ byte) int {
-	switch typ {
-	case 2: // object
-		return r.idSize
-	case 4: // boolean
-		return 1
-	case 5: // char
-		return 2
-	case 6: // float
-		return 4
-	case 7: // double
-		return 8
-	case 8: // byte
-		return 1
-	case 9: // short
-		return 2
-	case 10: // int
-		return 4
-	case 11: // long
-		return 8
+	switch hs := res.HeapSummary; {
+	case hs == nil:
+		fmt.Printf("SKIP\ttotal: no HEAP SUMMARY record\n")
+	case hs.LiveBytes == 0:
+		fmt.Printf("SKIP\ttotal: JVM reported 0 live bytes\n")
 	default:
-		r.errorf("unexpected basic type %x", typ)
+		ratio := float64(res.Total) / float64(hs.LiveBytes)
+		check("total", math.Abs(ratio-1) <= *maxDiscrepancy,
+			"computed %d vs. JVM %d live bytes (ratio %.3f; tolerance %.1f%%)",
+			res.Total, hs.LiveBytes, ratio, 100**maxDiscrepancy)
 	}
-	return 0
+	return ok
 }
 
-func (r *reader) readHeapDumpSegment() int {
-	tag := r.u1()
-	r.subTags[tag]++
-	n := 1
-	switch tag {
-	case 0xff: // ROOT UNKNOWN
-		r.id()
-		n += r.idSize
-	case 0x01: // ROOT JNI GLOBAL
-		r.id()
-		r.id()
-		n += r.idSize + r.idSize
-	case 0x02: // ROOT JNI LOCAL
-		r.id()
-		r.u4()
-		r.u4()
-		n += r.idSize + 4 + 4
-	case 0x03: // ROOT JAVA FRAME
-		r.id()
-		r.u4()
-		r.u4()
-		n += r.idSize + 4 + 4
-	case 0x04: // ROOT NATIVE STACK
-		r.id()
-		r.u4()
-		n += r.idSize + 4
-	case 0x05: // ROOT STICKY CLASS
-		r.id()
-		n += r.idSize
-	case 0x06: // ROOT THREAD BLOCK
-		r.id()
-		r.u4()
-		n += r.idSize + 4
-	case 0x07: // ROOT MONITOR USED
-		r.id()
-		n += r.idSize
-	case 0x08: // ROOT THREAD OBJECT
-		r.id()
-		r.u4()
-		r.u4()
-		n += r.idSize + 4 + 4
-	case 0x20: // CLASS DUMP
-		classObjectID := r.id()
-		c, ok := r.classByID[classObjectID]
-		if !ok {
-			r.errorf("class dump referred to bad class object id %d", classObjectID)
-		}
-		_ = c
-		r.u4() // stack trace serial #
-		r.id() // super class object ID
-		r.id() // class loader object ID
-		r.id() // signers object ID
-		r.id() // protection domain object ID
-		r.id() // reserved
-		r.id() // reserved
-		r.u4() // instance size
-		n += r.idSize + 4 + r.idSize + r.idSize + r.idSize + r.idSize + r.idSize + r.idSize + 4
-
-		numCP := int(r.u2())
-		n += 2
-		//ln("CP", numCP)
-		for i := 0; i < numCP; i++ {
-			r.u2() // constant pool index
-			typ := r.u1()
-			w := r.basicSize(typ)
-			r.ignore(w)
-			n += 2 + 1 + w
-		}
-
-		numSF := int(r.u2())
-		n += 2
-		//fmt.Println("SF", numSF)
-		for i := 0; i < numSF; i++ {
-			r.id() // static field name string ID
-			typ := r.u1()
-			w := r.basicSize(typ)
-			r.ignore(w)
-			n += r.idSize + 1 + w
-		}
-
-		numIF := int(r.u2())
-		n += 2
-		//fmt.Println("IF", numIF)
-		for i := 0; i < numIF; i++ {
-			r.id() // field name string ID
-			r.u1() // type of field
-			n += r.idSize + 1
-		}
-	case 0x21: // INSTANCE DUMP
-		r.id() // object ID
-		traceSerial := r.u4()
-		r.id() // class object ID
-		nn := int(r.u4())
-		r.ignore(nn)
-		n += r.idSize + 4 + r.idSize + 4 + nn
-
-		size := int64(nn) + instanceHeaderSize
-		r.total += size
-		r.instanceOverhead += instanceHeaderSize
-		r.traceSizes[traceSerial] += size
-	case 0x22: // OBJECT ARRAY DUMP
-		r.id() // array object ID
-		traceSerial := r.u4()
-		nn := int(r.u4())
-		r.id() // array class object ID
-		for i := 0; i < nn; i++ {
-			r.id()
-		}
-		n += r.idSize + 4 + 4 + r.idSize + nn*r.idSize
-
-		size := int64(nn*r.idSize) + objectArrayHeaderSize
-		r.total += size
-		r.objectArrayOverhead += objectArrayHeaderSize
-		r.traceSizes[traceSerial] += size
-	case 0x23: // PRIMITIVE ARRAY DUMP
-		r.id() // array object ID
-		traceSerial := r.u4()
-		nn := int(r.u4())
-		typ := r.u1()
-		w := r.basicSize(typ)
-		r.ignore(nn * w)
-		n += r.idSize + 4 + 4 + 1 + nn*w
+func sumCounts(counts []int) int {
+	sum := 0
+	for _, c := range counts {
+		sum += c
+	}
+	return sum
+}
 
-		size := int64(nn*w) + primitiveArrayHeaderSize
-		r.total += size
-		r.primitiveArrayOverhead += primitiveArrayHeaderSize
-		r.traceSizes[traceSerial] += size
-	default:
-		r.errorf("unknown sub-tag %x", tag)
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
 	}
 	return n
 }
-
-func (r *reader) readRecord() (done bool) {
-	var b [1]byte
-	if _, err := io.ReadFull(r, b[:]); err != nil {
-		if err == io.EOF {
-			return true
-		}
-		r.error(err)
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [OPTIONS] FILENAME\nwhere OPTIONS are:\n", os.Args[0])
+		flag.PrintDefaults()
 	}
-	tag := b[0]
-	r.tags[tag]++
-	r.u4() // timestamp
-	n := int(r.u4())
-
-	switch tag {
-	case 0x01: // STRING IN UTF8
-		r.readString(n)
-	case 0x02: // LOAD CLASS
-		r.readClass(n)
-	case 0x04: // STACK FRAME
-		r.readFrame(n)
-	case 0x05: // STACK TRACE
-		r.readTrace(n)
-	case 0x1c: // HEAP DUMP SEGMENT
-		for n > 0 {
-			n -= r.readHeapDumpSegment()
-		}
-		//return true // TODO: remove
-	default:
-		r.ignore(n)
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
 	}
-
-	return false
-}
-
-func (r *reader) readHeader() {
-	s, err := r.ReadString(0)
+	f, err := infile.Open(flag.Arg(0))
 	if err != nil {
-		r.error(err)
-	}
-	if s != "JAVA PROFILE 1.0.2\x00" {
-		r.errorf("bad header string %q", s)
+		log.Fatal(err)
 	}
-	idSize := r.u4()
-	if idSize != 8 {
-		r.errorf("only id size of 8 handled; got %d", idSize)
+	defer f.Close()
 
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	opts, err := headerSizeOptions(setFlags)
+	if err != nil {
+		log.Fatal(err)
 	}
-	r.idSize = int(idSize)
-	// Skip the timestamp stuff for now.
-	r.u4()
-	r.u4()
-}
-
-func (r *reader) readAll() (err error) {
-	defer func() {
-		if e := recover(); e != nil {
-			re, ok := e.(readerError)
-			if !ok {
-				panic(e)
-			}
-			err = re.err
+	opts.ValidateUTF8 = *validateUTF8
+	opts.StrictUTF8 = *strict
+	if *classPattern != "" {
+		re, err := regexp.Compile(*classPattern)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}()
-
-	r.readHeader()
-	for !r.readRecord() {
+		opts.ClassFilter = re
 	}
-	return nil
-}
-
-func top10(m map[uint32]int64) []serialSize {
-	var h serialSizes
-	for serial, size := range m {
-		ss := serialSize{serial: serial, size: size}
-		if len(h) < 10 {
-			heap.Push(&h, ss)
-			continue
+	if *objectID != "" {
+		id, err := strconv.ParseUint(*objectID, 0, 64)
+		if err != nil {
+			log.Fatalf("bad -object %q: %s", *objectID, err)
+		}
+		opts.KeepInstances = true
+		h, err := hprof.ParseOptions(f, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := printObject(h, id); err != nil {
+			log.Fatal(err)
 		}
-		if ss.size > h[0].size {
-			h[0] = ss
-			heap.Fix(&h, 0)
+		return
+	}
+	opts.ObjectGraph = *retainedTop > 0
+	res, err := hprof.Analyze(f, opts)
+	if *verifyDump {
+		if !verify(res, err) {
+			fmt.Println("FAIL")
+			os.Exit(1)
 		}
+		fmt.Println("PASS")
+		return
 	}
-	for i := 0; i < len(h)/2; i++ {
-		j := len(h) - 1 - i
-		h[i], h[j] = h[j], h[i]
+	if err != nil {
+		// The warnings found before the error may help explain it.
+		if res != nil {
+			reportWarnings(res.Warnings)
+		}
+		log.Fatal(err)
 	}
-	return []serialSize(h)
-}
-
-type serialSize struct {
-	serial uint32
-	size   int64
+	printResult(res)
+	reportWarnings(res.Warnings)
 }
 
-type serialSizes []serialSize
-
-func (s *serialSizes) Len() int           { return len(*s) }
-func (s *serialSizes) Less(i, j int) bool { return (*s)[i].size < (*s)[j].size }
-func (s *serialSizes) Swap(i, j int)      { (*s)[i], (*s)[j] = (*s)[j], (*s)[i] }
-func (s *serialSizes) Push(x interface{}) { *s = append(*s, x.(serialSize)) }
-func (s *serialSizes) Pop() interface{} {
-	n := len(*s)
-	v := (*s)[n-1]
-	*s = (*s)[:n-1]
-	return v
+// reportWarnings writes the warnings to -warnings-file, if given, and otherwise summarizes them (unless -quiet
+// is given).
+func reportWarnings(warnings []hprof.Warning) {
+	if *warningsFile != "" {
+		if err := writeWarnings(*warningsFile, warnings); err != nil {
+			log.Fatal(err)
+		}
+	} else if !*quiet {
+		summarizeWarnings(warnings)
+	}
 }
 
-func main() {
-	log.SetFlags(0)
-	if len(os.Args) != 2 {
-		log.Fatalf("usage: %s FILENAME", os.Args[0])
+// printResult prints the analysis, with the detailed reports selected by the flags.
+func printResult(res *hprof.Result) {
+	h := res.Heap
+	fmt.Println(res.Strings, "strings")
+	if *validateUTF8 {
+		fmt.Println(res.InvalidStrings, "strings with invalid UTF-8")
 	}
-	f, err := os.Open(os.Args[1])
-	if err != nil {
-		log.Fatal(err)
+	fmt.Println(res.Classes, "classes")
+	if res.UnloadedClasses > 0 {
+		fmt.Println(res.UnloadedClasses, "unloaded classes")
 	}
-	defer f.Close()
-
-	r := newReader(f)
-	if err := r.readAll(); err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println(len(r.strings), "strings")
-	fmt.Println(len(r.classByID), "classes")
-	fmt.Println(len(r.traceBySerial), "stack traces")
+	fmt.Println(res.StackTraces, "stack traces")
 	fmt.Println()
-	fmt.Println("total size:", r.total)
+	fmt.Println("total size:", res.Total)
+	if hs := res.HeapSummary; hs != nil {
+		fmt.Printf("JVM heap summary: %d live bytes (%s) in %d instances; %d bytes allocated in %d instances\n",
+			hs.LiveBytes, humanize.Bytes(uint64(hs.LiveBytes)), hs.LiveInstances,
+			hs.AllocatedBytes, hs.AllocatedInstances)
+		if diff := res.Total - int64(hs.LiveBytes); diff != 0 {
+			fmt.Printf("computed total differs from JVM live bytes by %d (%s)\n",
+				diff, humanize.Bytes(uint64(abs64(diff))))
+		}
+	}
+	if *compareToJVMTotal {
+		compareToJVM(res)
+	}
 	fmt.Println("top 10 stacks:")
-	for _, ss := range top10(r.traceSizes) {
-		fmt.Printf("%d\t%d\t(%s)\n", ss.serial, ss.size, humanize.Bytes(uint64(ss.size)))
-		fmt.Println(r.traceBySerial[ss.serial])
+	for _, ss := range res.TopStacks {
+		fmt.Printf("%d\t%d\t(%s)\n", ss.Serial, ss.Size, humanize.Bytes(uint64(ss.Size)))
+		fmt.Println(formatStack(ss))
+	}
+	if *histogramTop > 0 {
+		printHistogram(res.Histogram, *histogramTop)
+	}
+	if *classPattern != "" {
+		printClassStacks(res)
+	}
+	if len(h.Roots) > 0 {
+		printRoots(h)
+	}
+	if *retainedTop > 0 {
+		if err := printRetained(h, *retainedTop); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *topAllocatingMethods {
+		fmt.Println()
+		fmt.Println("top 10 allocating methods:")
+		methods := allocatingMethods(h)
+		if len(methods) > 10 {
+			methods = methods[:10]
+		}
+		for _, ms := range methods {
+			fmt.Printf("%d\t(%s)\t%s\n", ms.size, humanize.Bytes(uint64(ms.size)), ms.method)
+		}
+	}
+	if *topCumulativeMethods {
+		fmt.Println()
+		fmt.Println("top 10 methods by cumulative bytes:")
+		methods := cumulativeMethods(h)
+		if len(methods) > 10 {
+			methods = methods[:10]
+		}
+		for _, ms := range methods {
+			fmt.Printf("%d\t(%s)\t%s\n", ms.size, humanize.Bytes(uint64(ms.size)), ms.method)
+		}
+	}
+	if len(h.CPUSamples) > 0 {
+		printCPUSamples(h)
 	}
 	fmt.Println()
 	fmt.Printf("instance overhead: %d (%s)\n",
-		r.instanceOverhead, humanize.Bytes(uint64(r.instanceOverhead)))
+		res.InstanceOverhead, humanize.Bytes(uint64(res.InstanceOverhead)))
 	fmt.Printf("object array overhead: %d (%s)\n",
-		r.objectArrayOverhead, humanize.Bytes(uint64(r.objectArrayOverhead)))
+		res.ObjectArrayOverhead, humanize.Bytes(uint64(res.ObjectArrayOverhead)))
 	fmt.Printf("primitive array overhead: %d (%s)\n",
-		r.primitiveArrayOverhead, humanize.Bytes(uint64(r.primitiveArrayOverhead)))
-	overhead := r.instanceOverhead + r.objectArrayOverhead + r.primitiveArrayOverhead
+		res.PrimitiveArrayOverhead, humanize.Bytes(uint64(res.PrimitiveArrayOverhead)))
+	overhead := res.InstanceOverhead + res.ObjectArrayOverhead + res.PrimitiveArrayOverhead
 	fmt.Printf("total overhead: %d/%d (%s / %s) %.2f%%\n",
-		overhead, r.total,
-		humanize.Bytes(uint64(overhead)), humanize.Bytes(uint64(r.total)),
-		(float64(overhead)/float64(r.total))*100)
+		overhead, res.Total,
+		humanize.Bytes(uint64(overhead)), humanize.Bytes(uint64(res.Total)),
+		(float64(overhead)/float64(res.Total))*100)
 	fmt.Println()
 	fmt.Println("tags:")
-	for i, c := range r.tags {
+	for i, c := range res.Tags {
 		if c > 0 {
 			fmt.Printf("%#2x\t%d\n", i, c)
 		}
 	}
 	fmt.Println()
 	fmt.Println("sub-tags:")
-	for i, c := range r.subTags {
+	for i, c := range res.SubTags {
 		if c > 0 {
 			fmt.Printf("%#2x\t%d\n", i, c)
 		}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cespare/hprofviz/hprof"
+)
+
+// headerSizes analyzes the named dump in the hprof package's testdata with opts and returns the header sizes
+// it used.
+func headerSizes(t *testing.T, name string, opts hprof.Options) [3]int64 {
+	t.Helper()
+	f, err := os.Open(filepath.Join("..", "hprof", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	res, err := hprof.Analyze(f, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := res.Heap
+	return [3]int64{h.InstanceHeaderSize, h.ObjectArrayHeaderSize, h.PrimitiveArrayHeaderSize}
+}
+
+func TestHeaderSizeOptions(t *testing.T) {
+	defer func(old string) { *oops = old }(*oops)
+	for _, tt := range []struct {
+		oops string
+		set  map[string]bool
+		dump string
+		want [3]int64
+	}{
+		// Without flags, the sizes depend on the id size.
+		{"", nil, "heap.hprof", [3]int64{16, 24, 24}},
+		{"", nil, "heap4.hprof", [3]int64{8, 12, 12}},
+		{"", map[string]bool{"instance-header": true}, "heap.hprof", [3]int64{16, 24, 24}},
+		{"compressed", nil, "heap.hprof", [3]int64{12, 16, 16}},
+		{"compressed", nil, "heap4.hprof", [3]int64{12, 16, 16}},
+		{"uncompressed", map[string]bool{"instance-header": true}, "heap.hprof", [3]int64{16, 24, 24}},
+	} {
+		*oops = tt.oops
+		opts, err := headerSizeOptions(tt.set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := headerSizes(t, tt.dump, opts); got != tt.want {
+			t.Errorf("-oops=%q with %v on %s: got header sizes %v; want %v", tt.oops, tt.set, tt.dump, got, tt.want)
+		}
+	}
+
+	*oops = "tiny"
+	if _, err := headerSizeOptions(nil); err == nil {
+		t.Error("got no error for -oops=tiny")
+	}
+}
+
+func TestCumulativeMethods(t *testing.T) {
+	class := &hprof.Class{Name: "C"}
+	frame := func(method string) *hprof.Frame {
+		return &hprof.Frame{Method: method, Signature: "()V", Class: class}
+	}
+	mainFrame, run, alloc := frame("main"), frame("run"), frame("alloc")
+	h := &hprof.Heap{
+		TraceBySerial: map[uint32]*hprof.Trace{
+			1: {Serial: 1, Frames: []*hprof.Frame{alloc, run, mainFrame}},
+			2: {Serial: 2, Frames: []*hprof.Frame{run, mainFrame}},
+			3: {Serial: 3, Frames: []*hprof.Frame{alloc, run, run, mainFrame}}, // recursion
+		},
+		TraceSizes: map[uint32]int64{1: 100, 2: 20, 3: 5},
+	}
+	got := make(map[string]int64)
+	for _, ms := range cumulativeMethods(h) {
+		got[ms.method] = ms.size
+	}
+	// Every stack has main at its root, so its cumulative bytes are the total. A stack is only counted once
+	// toward a method it calls recursively.
+	want := map[string]int64{"C.main()V": 125, "C.run()V": 125, "C.alloc()V": 105}
+	if len(got) != len(want) {
+		t.Errorf("got methods %v; want %v", got, want)
+	}
+	for method, size := range want {
+		if got[method] != size {
+			t.Errorf("got %d cumulative bytes for %s; want %d", got[method], method, size)
+		}
+	}
+
+	leaves := allocatingMethods(h)
+	if len(leaves) != 2 || leaves[0] != (methodSize{"C.alloc()V", 105}) || leaves[1] != (methodSize{"C.run()V", 20}) {
+		t.Errorf("got allocating methods %v; want alloc with 105 bytes and run with 20", leaves)
+	}
+}
@@ -1,57 +1,887 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/hprofviz/internal/infile"
 )
 
 var (
 	topk      = flag.Int("topk", -1, "Only keep the top k most frequently sampled nodes and their ancestors")
 	regex     = flag.String("regex", "", "Only keep matching sampled nodes and their ancestors")
 	threshold = flag.Float64("threshold", 0.05, "Exclude nodes sampled fewer than this ratio of the sample count")
+	format    = flag.String("format", "dot", "Output format: dot, treemap-json, graphml, csv, folded, pprof, or html (needs Graphviz)")
+	edgeLabel = flag.String("edgelabel", "total",
+		"Edge labels: total (samples and share of the total), or rich (also the share of the caller's outbound samples)")
+	edgeMinLabel   = flag.Float64("edge-min-label", 0, "Omit labels on edges below this ratio of the sample count")
+	abbreviatePkgs = flag.Bool("abbreviate-packages", false,
+		"In node labels, shorten all but the last package component to its first letter (com.example.foo to c.e.foo)")
+	renderTimeout = flag.Duration("render-timeout", time.Minute,
+		"With -format html, kill dot (from Graphviz) if it takes longer than this (0 for no limit)")
+	noSelfLoops = flag.Bool("no-self-loops", false,
+		"Omit edges from a node to itself (from recursion), noting their weight in the node's label instead")
+	richLegend   = flag.Bool("rich-legend", false, "List the call sites with the most self samples in the legend")
+	edgeCountMin = flag.Int("edge-count-min", 0, "Hide edges with fewer than this many samples")
+	keepFrames   = flag.String("keep-frames", "", "Only keep stack frames matching this regex, folding out the others")
+	verbose      = flag.Bool("v", false, "Verbose mode: run internal consistency checks")
+	granularity  = flag.String("granularity", "line",
+		"Merge call sites by: line, function (ignoring line and signature), or signature (ignoring line)")
+	labelEncoding = flag.String("label-encoding", "utf8",
+		"Encoding of DOT labels: utf8, or ascii to write non-ASCII characters as character references")
+	selfOnly     = flag.Bool("self-only", false, "Only render nodes with self samples, without any edges")
+	includeEmpty = flag.Bool("include-empty-counts", false,
+		"Keep nodes without self samples (interior frames) in self-focused views such as -self-only")
+	chunks = flag.String("chunks", "",
+		"Read the profile from the files matching this glob (which may be gzipped), in sorted order, instead of one file")
+	tarInput       = flag.Bool("tar", false, "Read the profiles in a tar archive (which may be gzipped) and merge them")
+	tarGlob        = flag.String("tar-glob", "*", "With -tar, only read archive members whose base names match this glob")
+	mergeThreshold = flag.Int("merge-threshold", 0,
+		"With -tar, drop traces with fewer than this many samples summed across the archive members")
+	minEdgeWeight = flag.Float64("min-edge-weight", 0,
+		"Remove edges below this ratio of the sample count, except those keeping each node connected to a root")
+	minSelf = flag.Float64("min-self", 0, "Remove nodes with fewer self samples than this ratio of the sample count")
+	minCum  = flag.Float64("min-cum", 0,
+		"Remove nodes with fewer cumulative samples than this ratio of the sample count")
+	minMode = flag.String("min-mode", "both",
+		"With -min-self and -min-cum, remove nodes failing both thresholds, or either of them")
+	collapseBelow = flag.Float64("collapse-below", 0,
+		"Fold call sites below this ratio of the sample count into an [other] node for each caller")
+	sampleInterval = flag.Duration("interval", 0,
+		"Sampling interval, for estimating CPU time (default: the interval given in the dump, if any)")
+	keepNative = flag.Bool("keep-native", true,
+		"Keep native (and compiled) method frames; with -keep-native=false, fold them into their neighbors")
+	excludeGenerated = flag.Bool("exclude-generated", false,
+		"Remove generated frames (lambdas, proxies, reflection accessors; see -generated-frames) from stacks")
+	generatedFrames = flag.String("generated-frames", defaultGeneratedFrames,
+		"With -exclude-generated, the regex matching the names of generated frames")
+	bidiEdges = flag.String("bidi-edges", "both",
+		"For edges in both directions between two nodes, draw both, only the heavier, or the lighter as dashed")
+	heat    = flag.Bool("heat", false, "Color nodes by their cumulative sample count (same as -color-by heat)")
+	colorBy = flag.String("color-by", "",
+		"Color nodes by: heat (cumulative samples) or line (shades of each method's lines by their samples)")
+	palette   = flag.String("palette", "red", "With -heat, the color scheme: red, blue, or viridis (colorblind-safe)")
+	colorBase = flag.String("color-base", "global",
+		"With -heat, color relative to the whole profile (global) or to the hottest node shown (focus)")
+	listTraces    = flag.Bool("list-traces", false, "Print the (filtered) traces, with their stacks, instead of a graph")
+	expandRepeats = flag.Bool("expand-repeats", false,
+		`Expand frames with a repeat suffix (as in "a.B.c(B.java:10) x3") into that many frames`)
+	summary    = flag.Bool("summary", false, "Print a short digest of the hottest call sites instead of a graph")
+	listFrames = flag.Bool("list-frames", false,
+		"Print each distinct frame (method, file, and line) in the (filtered) traces instead of a graph")
+	keepOrder    = flag.Bool("keep-order", false, "With -list-traces, list traces in file order rather than by count")
+	quiet        = flag.Bool("quiet", false, "Suppress informational messages")
+	mergeUnknown = flag.String("merge-unknown", "none",
+		"Merge frames without source information: none, method, or all (into one [unknown] node)")
+	validateStacks = flag.Bool("validate-stacks", false,
+		"Warn about suspicious stacks, such as a thread entry method below the root (signs of a corrupt dump)")
+	hashNames   = flag.Bool("hash-names", false, "Replace method and file names with hashes, for sharing profiles")
+	hashLines   = flag.Bool("hash-lines", false, "With -hash-names, also replace line numbers with hashes")
+	stripArgs   = flag.Bool("strip-args", false, "Remove argument lists from method names, merging overloads")
+	utilization = flag.Bool("utilization", false,
+		"Print the ratio of sampled CPU time to wall time (needs timestamps and a sampling interval)")
+	foldLeafRecursion = flag.Bool("fold-leaf-recursion", false,
+		"Fold frames directly below a trace's leaf that are in the same method into the leaf")
+	combineSiblings = flag.Bool("combine-siblings", false,
+		"Merge call sites with the same method and file called by the same caller (from different lines)")
+	rootAt = flag.String("root-at", "",
+		"Root each trace at its root-most frame matching this regex, dropping the frames above (and other traces)")
+	threads     = flag.Bool("threads", false, "Write a separate graph for each thread (needs a dump taken with thread=y)")
+	threadsTopN = flag.Int("threads-topn", 0,
+		"With -threads, only give the N busiest threads their own graph, lumping the rest into one")
+	concurrency = flag.Int("concurrency", 1, "With -output-dir, the number of inputs to process at once")
+	outputDir   = flag.String("output-dir", "",
+		"Render each input file to a file of the same base name in this directory (created if needed)")
+	graphStats    = flag.Bool("graph-stats", false, "Print structural statistics about the rendered graph")
+	weightByDepth = flag.Float64("weight-by-depth", 0,
+		"Experimental: scale samples counted toward interior nodes by this factor (0 to 1) per frame above the leaf")
+	outputGzip = flag.Bool("output-gzip", false, "Gzip the output (implied by an output filename ending in .gz)")
+	strict     = flag.Bool("strict", false, "Fail on samples of traces that the dump doesn't define, rather than ignoring them")
+	regexMatch = flag.String("regex-match", "leaf",
+		"With -regex, match the sampled frame of each trace (leaf) or keep traces with any matching frame (any)")
+	regexFilename = flag.Bool("regex-filename", false, "With -regex and -exclude, also match the source filenames of frames")
+	exclude       = flag.String("exclude", "",
+		"Drop traces whose sampled frame matches this regex (or any frame, with -regex-match any)")
+	foldedLines = flag.Bool("folded-lines", false, "With -format folded, give the file and line of each frame")
 )
 
+// defaultGeneratedFrames matches the names of frames in code generated at runtime: lambdas, dynamic proxies,
+// reflection accessors, and CGLIB-enhanced classes.
+const defaultGeneratedFrames = `\$\$Lambda\$|\.\$Proxy\d+\.|\.Generated(Serialization)?(Method|Constructor)Accessor\d+\.|` +
+	`\$\$(EnhancerBy|FastClassBy)[A-Za-z]*CGLIB\$\$`
+
+// Options controls filtering and rendering. The hprofviz command populates it from flags.
+type Options struct {
+	// Reading the profile (see render).
+	Parse          ParseOptions  // how to parse the dump
+	SampleInterval time.Duration // if positive, the sampling interval, overriding the one given in the dump
+	Tar            bool          // the input is a tar archive of profiles to merge; see ParseTar
+	TarGlob        string        // with Tar, the glob matching the base names of the members to read
+	MergeThreshold int           // with Tar, drop merged traces with fewer samples
+	Utilization    bool          // print the ratio of sampled CPU time to wall time
+	ValidateStacks bool          // warn about suspicious stacks; see ValidateStacks
+	TraceIDs       []int         // if non-empty, only keep the traces with these IDs
+	HashNames      bool          // anonymize the call sites; see HashNames
+	HashLines      bool          // with HashNames, also hash line numbers
+	Threads        bool          // render each thread to its own output; see PartitionByThread
+	ThreadsTopN    int           // with Threads, if positive, the number of threads given their own output
+
+	TopK          int            // if positive, only keep the TopK most frequently sampled traces
+	Regex         *regexp.Regexp // if non-nil, only keep traces whose sampled node matches
+	RegexAny      bool           // keep traces with any frame matching Regex, not just the sampled node
+	RegexFilename bool           // also match Regex (and Exclude) against frames' filenames
+	Exclude       *regexp.Regexp // if non-nil, drop traces whose sampled node (or any frame, with RegexAny) matches
+	Threshold     float64        // exclude nodes sampled fewer than this ratio of the sample count
+	MinSelf       float64        // remove nodes with fewer self samples than this ratio of the sample count
+	MinCum        float64        // remove nodes with fewer cumulative samples than this ratio of the sample count
+	MinMode       string         // "both" or "either": which failed thresholds of MinSelf and MinCum remove a node
+	MinEdgeWeight float64        // remove lighter edges, except those keeping the graph connected; see PruneEdges
+	CollapseBelow float64        // fold call sites below this ratio of the sample count into [other] nodes
+	DepthDecay    float64        // if positive, weight cumulative counts and edges by this factor per level
+
+	KeepFrames        *regexp.Regexp // if non-nil, remove non-matching frames from each stack
+	ExcludeGenerated  *regexp.Regexp // if non-nil, remove matching (generated) frames from each stack
+	KeepNative        bool           // if false, remove native and compiled method frames from each stack
+	RootAt            *regexp.Regexp // if non-nil, re-root each trace at its root-most matching frame
+	StripArgs         bool           // remove signatures from call sites
+	Granularity       string         // "line", "function", or "signature"; see granularities
+	MergeUnknown      string         // "none", "method", or "all"; see MergeUnknown
+	CombineSiblings   bool           // merge same-named call sites that share a caller; see CombineSiblings
+	FoldLeafRecursion bool           // fold recursive frames directly below each leaf into the leaf
+
+	Format             string  // "dot", "treemap-json", "graphml", "csv", "folded", "pprof", or "html"
+	Filename           string  // input filename, shown in the legend
+	EdgeMinLabel       float64 // edges below this ratio of the sample count are drawn without a label
+	EdgeCountMin       int     // edges with fewer samples are not drawn
+	EdgeLabel          string  // "total" or "rich" (also giving the fraction of the caller's outbound samples)
+	LabelEncoding      string  // "utf8" or "ascii"; see escapeLabel
+	SelfOnly           bool    // only render nodes with self samples, without edges
+	IncludeEmptyCounts bool    // keep nodes without self samples in self-focused views (-self-only, HTML tables)
+	ColorBy            string  // "heat", "line", or empty for no coloring
+	Palette            string  // heat coloring palette (see palettes); empty for no heat coloring
+	ColorBase          string  // "global" or "focus": what heat colors are relative to
+	ProfileTotal       int     // sample count of the whole profile, before filtering
+	BidiEdges          string  // "both", "heavier", or "dashed": how to draw the lighter of two opposing edges
+	GraphStats         bool    // print structural statistics about the graph
+	RichLegend         bool    // list the hottest call sites in the legend
+	AbbreviatePackages bool    // shorten package names in node labels; see abbreviatePackages
+	NoSelfLoops        bool    // omit edges from a node to itself, noting their weight in the node's label
+	FoldedLines        bool    // with Format "folded", give the file and line of each frame
+
+	RenderTimeout time.Duration // if positive, the time allowed for running dot (for -format html)
+	OutputGzip    bool          // gzip-compress the output
+
+	// Instead of rendering, print the filtered traces (in file order, with KeepOrder), their distinct frames,
+	// or a summary of them.
+	ListTraces bool
+	KeepOrder  bool
+	ListFrames bool
+	Summary    bool
+
+	Chunks bool // the input name is a glob pattern of chunk files; see openChunks
+
+	Verbose    bool   // run internal consistency checks
+	Quiet      bool   // suppress informational messages
+	InfoPrefix string // prefix of informational messages, such as the input name when rendering several
+	InfoStderr bool   // print informational messages to stderr rather than stdout, which has the output
+}
+
+// optionsFromFlags builds Options from the command-line flags.
+func optionsFromFlags() (Options, error) {
+	opts := Options{
+		TopK:               *topk,
+		RegexFilename:      *regexFilename,
+		Threshold:          *threshold,
+		Format:             *format,
+		EdgeMinLabel:       *edgeMinLabel,
+		EdgeCountMin:       *edgeCountMin,
+		RichLegend:         *richLegend,
+		EdgeLabel:          *edgeLabel,
+		AbbreviatePackages: *abbreviatePkgs,
+		NoSelfLoops:        *noSelfLoops,
+		FoldedLines:        *foldedLines,
+		RenderTimeout:      *renderTimeout,
+		OutputGzip:         *outputGzip,
+		ListTraces:         *listTraces,
+		KeepOrder:          *keepOrder,
+		ListFrames:         *listFrames,
+		Summary:            *summary,
+		Chunks:             *chunks != "",
+		MinSelf:            *minSelf,
+		MinCum:             *minCum,
+		MinMode:            *minMode,
+		DepthDecay:         *weightByDepth,
+		GraphStats:         *graphStats,
+		Verbose:            *verbose,
+		Quiet:              *quiet,
+		Granularity:        *granularity,
+		LabelEncoding:      *labelEncoding,
+		SelfOnly:           *selfOnly,
+		IncludeEmptyCounts: *includeEmpty,
+		MinEdgeWeight:      *minEdgeWeight,
+		CollapseBelow:      *collapseBelow,
+		BidiEdges:          *bidiEdges,
+		MergeUnknown:       *mergeUnknown,
+		CombineSiblings:    *combineSiblings,
+		FoldLeafRecursion:  *foldLeafRecursion,
+		KeepNative:         *keepNative,
+		StripArgs:          *stripArgs,
+		Parse:              ParseOptions{ExpandRepeats: *expandRepeats, Strict: *strict},
+		SampleInterval:     *sampleInterval,
+		Tar:                *tarInput,
+		TarGlob:            *tarGlob,
+		MergeThreshold:     *mergeThreshold,
+		Utilization:        *utilization,
+		ValidateStacks:     *validateStacks,
+		TraceIDs:           traceIDs,
+		HashNames:          *hashNames,
+		HashLines:          *hashLines,
+		Threads:            *threads,
+		ThreadsTopN:        *threadsTopN,
+	}
+	if *quiet && *verbose {
+		return opts, errors.New("Cannot provide both -quiet and -v.")
+	}
+	if *mergeThreshold > 0 && !*tarInput {
+		return opts, errors.New("-merge-threshold requires -tar.")
+	}
+	if *topk > 0 && *regex != "" {
+		return opts, errors.New("Cannot provide both -topk and -regexp.")
+	}
+	switch *regexMatch {
+	case "leaf":
+	case "any":
+		opts.RegexAny = true
+	default:
+		return opts, fmt.Errorf("Unknown -regex-match %q.", *regexMatch)
+	}
+	switch *format {
+	case "dot", "treemap-json", "graphml", "html", "csv", "folded", "pprof":
+	default:
+		return opts, fmt.Errorf("Unknown -format %q.", *format)
+	}
+	switch *labelEncoding {
+	case "utf8", "ascii":
+	default:
+		return opts, fmt.Errorf("Unknown -label-encoding %q.", *labelEncoding)
+	}
+	switch *colorBy {
+	case "":
+		if *heat {
+			opts.ColorBy = "heat"
+		}
+	case "heat", "line":
+		opts.ColorBy = *colorBy
+	default:
+		return opts, fmt.Errorf("Unknown -color-by %q.", *colorBy)
+	}
+	if opts.ColorBy == "heat" {
+		if _, ok := palettes[*palette]; !ok {
+			return opts, fmt.Errorf("Unknown -palette %q.", *palette)
+		}
+		opts.Palette = *palette
+	}
+	switch *colorBase {
+	case "global", "focus":
+		opts.ColorBase = *colorBase
+	default:
+		return opts, fmt.Errorf("Unknown -color-base %q.", *colorBase)
+	}
+	switch *edgeLabel {
+	case "total", "rich":
+	default:
+		return opts, fmt.Errorf("Unknown -edgelabel %q.", *edgeLabel)
+	}
+	switch *minMode {
+	case "both", "either":
+	default:
+		return opts, fmt.Errorf("Unknown -min-mode %q.", *minMode)
+	}
+	if *weightByDepth < 0 || *weightByDepth > 1 {
+		return opts, fmt.Errorf("-weight-by-depth must be between 0 and 1.")
+	}
+	switch *mergeUnknown {
+	case "none", "method", "all":
+	default:
+		return opts, fmt.Errorf("Unknown -merge-unknown %q.", *mergeUnknown)
+	}
+	switch *bidiEdges {
+	case "both", "heavier", "dashed":
+	default:
+		return opts, fmt.Errorf("Unknown -bidi-edges %q.", *bidiEdges)
+	}
+	if _, ok := granularities[*granularity]; !ok {
+		return opts, fmt.Errorf("Unknown -granularity %q.", *granularity)
+	}
+	if *regex != "" {
+		reg, err := regexp.Compile(*regex)
+		if err != nil {
+			return opts, err
+		}
+		opts.Regex = reg
+	}
+	if *exclude != "" {
+		reg, err := regexp.Compile(*exclude)
+		if err != nil {
+			return opts, err
+		}
+		opts.Exclude = reg
+	}
+	if *keepFrames != "" {
+		reg, err := regexp.Compile(*keepFrames)
+		if err != nil {
+			return opts, err
+		}
+		opts.KeepFrames = reg
+	}
+	if *rootAt != "" {
+		reg, err := regexp.Compile(*rootAt)
+		if err != nil {
+			return opts, err
+		}
+		opts.RootAt = reg
+	}
+	if *excludeGenerated {
+		reg, err := regexp.Compile(*generatedFrames)
+		if err != nil {
+			return opts, err
+		}
+		opts.ExcludeGenerated = reg
+	}
+	return opts, nil
+}
+
 type CallSite struct {
 	Name            string
+	Synthetic       bool   // not a real frame, but a placeholder such as "[other]"
+	Signature       string // argument list, such as "(int, String)", if present in the dump
 	Filename        string
-	LineNumber      int // -1 is 'unknown'
+	LineNumber      int // -1 is 'unknown'; see also NativeMethodLine and CompiledMethodLine
 	Count           int
 	CumulativeCount int
 }
 
 type Trace struct {
-	ID    int
-	Stack []*CallSite
-	Count int
+	ID     int
+	Thread int // serial of the thread sampled, if the dump gives one (hprof's thread=y); 0 otherwise
+	Seq    int // position of the trace in the dump
+	Stack  []*CallSite
+	Count  int
+
+	// The other columns of the trace's row in the dump's CPU SAMPLES table (zero if the trace has no row).
+	// Unlike Count, they are not updated when traces are filtered or merged.
+	Rank         int
+	SelfPercent  float64 // the trace's share of the samples
+	AccumPercent float64 // the running total of SelfPercent, down to this trace's rank
 }
 
-type byCount []*Trace
+func (t *Trace) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "TRACE %d: %d samples\n", t.ID, t.Count)
+	for _, site := range t.Stack {
+		fmt.Fprintf(&buf, "  %s\n", site)
+	}
+	return buf.String()
+}
 
-func (w byCount) Len() int           { return len(w) }
-func (w byCount) Less(i, j int) bool { return w[i].Count < w[j].Count }
-func (w byCount) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
+// Sentinel line numbers of frames that hprof lists as being in a native or a compiled method, without a line.
+const (
+	NativeMethodLine   = -2
+	CompiledMethodLine = -3
+)
 
-func FilterTopK(traces map[*Trace]bool, k int) {
-	var orderedTraces []*Trace
+// isNative reports whether site is a native or compiled method frame.
+func isNative(site *CallSite) bool {
+	return site.LineNumber == NativeMethodLine || site.LineNumber == CompiledMethodLine
+}
+
+func (s *CallSite) String() string {
+	if s.Synthetic {
+		return s.Name
+	}
+	lineNumber := "???"
+	switch {
+	case s.LineNumber > 0:
+		lineNumber = strconv.Itoa(s.LineNumber)
+	case s.LineNumber == NativeMethodLine:
+		lineNumber = "native"
+	case s.LineNumber == CompiledMethodLine:
+		lineNumber = "compiled"
+	}
+	return fmt.Sprintf("%s%s[%s:%s]", s.Name, s.Signature, s.Filename, lineNumber)
+}
+
+// StackKey returns a key identifying stack: stacks have equal keys if their frames have the same names,
+// signatures, and filenames (and, if withLines is true, line numbers), in the same order.
+func StackKey(stack []*CallSite, withLines bool) string {
+	var buf bytes.Buffer
+	for _, site := range stack {
+		buf.WriteString(site.Name)
+		buf.WriteByte(0)
+		buf.WriteString(site.Signature)
+		buf.WriteByte(0)
+		buf.WriteString(site.Filename)
+		if withLines {
+			buf.WriteByte(0)
+			buf.WriteString(strconv.Itoa(site.LineNumber))
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// TraceKey returns a key identifying trace by its stack (see StackKey) and the thread it was sampled in, so
+// that traces with equal keys can be merged without losing their attribution to threads.
+func TraceKey(trace *Trace, withLines bool) string {
+	return strconv.Itoa(trace.Thread) + "\n" + StackKey(trace.Stack, withLines)
+}
+
+// SortedTraces returns traces in a stable order: by descending count, then by ID.
+func SortedTraces(traces map[*Trace]bool) []*Trace {
+	sorted := make([]*Trace, 0, len(traces))
+	for trace := range traces {
+		sorted = append(sorted, trace)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Count != sorted[j].Count {
+			return sorted[i].Count > sorted[j].Count
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
+
+// TracesInFileOrder returns traces in the order in which they appeared in the dump.
+func TracesInFileOrder(traces map[*Trace]bool) []*Trace {
+	sorted := make([]*Trace, 0, len(traces))
 	for trace := range traces {
-		orderedTraces = append(orderedTraces, trace)
+		sorted = append(sorted, trace)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Seq != sorted[j].Seq {
+			return sorted[i].Seq < sorted[j].Seq
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
+
+// FilterTopK keeps only the k most frequently sampled traces. If there are no more than k traces, it keeps them
+// all.
+func FilterTopK(traces map[*Trace]bool, k int) {
+	if k >= len(traces) {
+		return
 	}
-	sort.Sort(sort.Reverse(byCount(orderedTraces)))
+	orderedTraces := SortedTraces(traces)
 	for _, trace := range orderedTraces[k:] {
 		delete(traces, trace)
 	}
 }
 
-func FilterMatching(traces map[*Trace]bool, regex *regexp.Regexp) {
+// FilterTraceIDs keeps only the traces with the given IDs. It returns an error, without changing traces, if
+// any of the IDs is not the ID of a trace.
+func FilterTraceIDs(traces map[*Trace]bool, ids []int) error {
+	keep := make(map[int]bool)
+	for _, id := range ids {
+		keep[id] = false
+	}
+	for trace := range traces {
+		if _, ok := keep[trace.ID]; ok {
+			keep[trace.ID] = true
+		}
+	}
+	for _, id := range ids {
+		if !keep[id] {
+			return fmt.Errorf("There is no trace with ID %d.", id)
+		}
+	}
+	for trace := range traces {
+		if !keep[trace.ID] {
+			delete(traces, trace)
+		}
+	}
+	return nil
+}
+
+// FilterMatching keeps only the traces whose sampled (leaf) frame matches regex or, if anyFrame is set, the
+// traces with any matching frame. A frame matches if its name does or, if filename is set, its filename does.
+func FilterMatching(traces map[*Trace]bool, regex *regexp.Regexp, anyFrame, filename bool) {
+	for trace := range traces {
+		if !traceMatches(trace, regex, anyFrame, filename) {
+			delete(traces, trace)
+		}
+	}
+}
+
+// FilterExcluding is the opposite of FilterMatching: it removes the traces that FilterMatching would keep.
+func FilterExcluding(traces map[*Trace]bool, regex *regexp.Regexp, anyFrame, filename bool) {
+	for trace := range traces {
+		if traceMatches(trace, regex, anyFrame, filename) {
+			delete(traces, trace)
+		}
+	}
+}
+
+// traceMatches reports whether trace matches regex as described for FilterMatching.
+func traceMatches(trace *Trace, regex *regexp.Regexp, anyFrame, filename bool) bool {
+	stack := trace.Stack
+	if !anyFrame && len(stack) > 0 {
+		stack = stack[:1]
+	}
+	for _, site := range stack {
+		if regex.MatchString(site.Name) || (filename && regex.MatchString(site.Filename)) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrimFrames removes the frames for which keep returns false from each trace's stack, so that the remaining
+// frames are connected directly. If a trace's leaf is removed, its samples are attributed to the nearest
+// remaining frame. Traces with no remaining frames are deleted. TrimFrames returns the number of frames and
+// traces removed.
+func TrimFrames(traces map[*Trace]bool, keep func(*CallSite) bool) (frames, removedTraces int) {
 	for trace := range traces {
-		if !regex.MatchString(trace.Stack[0].Name) {
+		var stack []*CallSite
+		for _, site := range trace.Stack {
+			if keep(site) {
+				stack = append(stack, site)
+			} else {
+				frames++
+			}
+		}
+		if len(stack) == 0 {
 			delete(traces, trace)
+			removedTraces++
+			continue
+		}
+		trace.Stack = stack
+	}
+	return frames, removedTraces
+}
+
+// RerootAt makes the root-most frame matching re the root of each trace, dropping the frames above it.
+// Traces without a matching frame are deleted.
+func RerootAt(traces map[*Trace]bool, re *regexp.Regexp) {
+	for trace := range traces {
+		root := -1
+		for i := len(trace.Stack) - 1; i >= 0; i-- {
+			if re.MatchString(trace.Stack[i].Name) {
+				root = i
+				break
+			}
+		}
+		if root < 0 {
+			delete(traces, trace)
+			continue
+		}
+		trace.Stack = trace.Stack[:root+1]
+	}
+}
+
+// FoldLeafRecursion removes the frames directly below each trace's leaf that are in the same method as the
+// leaf (as in a tail-recursive or self-looping hot method), so that the leaf appears once and its self samples
+// aren't drawn as a self-loop. Recursion elsewhere in the stack is left alone. It returns the number of traces
+// changed.
+func FoldLeafRecursion(traces map[*Trace]bool) int {
+	changed := 0
+	for trace := range traces {
+		if len(trace.Stack) < 2 {
+			continue
+		}
+		leaf := trace.Stack[0]
+		n := 1
+		for n < len(trace.Stack) && trace.Stack[n].Name == leaf.Name && trace.Stack[n].Filename == leaf.Filename {
+			n++
+		}
+		if n > 1 {
+			trace.Stack = append([]*CallSite{leaf}, trace.Stack[n:]...)
+			changed++
+		}
+	}
+	return changed
+}
+
+// granularities maps each -granularity to a function giving the key by which call sites are merged. A nil
+// function means that call sites are not merged.
+var granularities = map[string]func(*CallSite) string{
+	"line": nil,
+	"function": func(site *CallSite) string {
+		return site.Name + "\x00" + site.Filename
+	},
+	"signature": func(site *CallSite) string {
+		return site.Name + "\x00" + site.Signature + "\x00" + site.Filename
+	},
+}
+
+// HashNames anonymizes the call sites in traces by replacing their names, signatures, and filenames (and, if
+// hashLines is true, line numbers) with stable hashes, preserving the structure of the graph and the counts.
+func HashNames(traces map[*Trace]bool, hashLines bool) {
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:4])
+	}
+	seen := make(map[*CallSite]bool)
+	for trace := range traces {
+		for _, site := range trace.Stack {
+			if seen[site] || site.Synthetic {
+				continue
+			}
+			seen[site] = true
+			if hashLines && site.LineNumber > 0 {
+				sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", site.Filename, site.LineNumber)))
+				site.LineNumber = 1 + int(binary.BigEndian.Uint16(sum[:]))
+			}
+			site.Name = hash(site.Name)
+			if site.Signature != "" {
+				site.Signature = "(" + hash(site.Signature) + ")"
+			}
+			if !unknownFilenames[site.Filename] {
+				site.Filename = hash(site.Filename)
+			}
+		}
+	}
+}
+
+// StripArgs removes the argument lists (signatures) from the call sites in traces, merging the call sites of
+// overloads that then become indistinguishable.
+func StripArgs(traces map[*Trace]bool) {
+	MergeCallSites(traces, func(site *CallSite) string {
+		return fmt.Sprintf("%s\x00%s\x00%d", site.Name, site.Filename, site.LineNumber)
+	})
+	for trace := range traces {
+		for _, site := range trace.Stack {
+			site.Signature = ""
+		}
+	}
+}
+
+// MergeCallSites replaces the CallSites in each trace's stack with a single shared CallSite for each distinct
+// key. If the merged call sites have differing line numbers, the line number of the result is unknown.
+func MergeCallSites(traces map[*Trace]bool, key func(*CallSite) string) {
+	merged := make(map[string]*CallSite)
+	for trace := range traces {
+		for i, site := range trace.Stack {
+			k := key(site)
+			m, ok := merged[k]
+			if !ok {
+				m = &CallSite{
+					Name:       site.Name,
+					Signature:  site.Signature,
+					Filename:   site.Filename,
+					LineNumber: site.LineNumber,
+				}
+				merged[k] = m
+			} else if m.LineNumber != site.LineNumber {
+				m.LineNumber = -1
+			}
+			if m.Signature != site.Signature {
+				m.Signature = ""
+			}
+			trace.Stack[i] = m
+		}
+	}
+}
+
+// unknownFilenames are the placeholders hprof (and hprofbin) use for frames without source information.
+var unknownFilenames = map[string]bool{
+	"Unknown Source": true,
+	"Native Method":  true,
+	"<unknown>":      true,
+}
+
+// isUnknown reports whether site lacks source information: its file or its line number is unknown.
+func isUnknown(site *CallSite) bool {
+	return !site.Synthetic && (unknownFilenames[site.Filename] || site.LineNumber <= 0)
+}
+
+// MergeUnknown coalesces the call sites without source information (see isUnknown). If perMethod is true,
+// the unknown call sites of each method are merged into a single call site with an unknown location;
+// otherwise all of them are merged into one synthetic "[unknown]" call site. Consecutive frames that merge
+// into the same call site are folded into one. MergeUnknown returns the number of frames merged.
+func MergeUnknown(traces map[*Trace]bool, perMethod bool) int {
+	merged := make(map[string]*CallSite)
+	frames := 0
+	for trace := range traces {
+		var stack []*CallSite
+		for _, site := range trace.Stack {
+			if isUnknown(site) {
+				frames++
+				key := ""
+				if perMethod {
+					key = site.Name
+				}
+				m, ok := merged[key]
+				if !ok {
+					if perMethod {
+						m = &CallSite{Name: site.Name, Filename: "Unknown Source", LineNumber: -1}
+					} else {
+						m = &CallSite{Name: "[unknown]", Synthetic: true, LineNumber: -1}
+					}
+					merged[key] = m
+				}
+				site = m
+			}
+			if len(stack) > 0 && stack[len(stack)-1] == site {
+				continue
+			}
+			stack = append(stack, site)
+		}
+		trace.Stack = stack
+	}
+	return frames
+}
+
+// CombineSiblings merges call sites with the same name and file that share a caller in some stack, such as
+// the calls to a method from different lines of another. This is like -granularity function, but only merges
+// call sites that are siblings in the graph. CombineSiblings returns the number of call sites merged away.
+func CombineSiblings(traces map[*Trace]bool) int {
+	type siblingKey struct {
+		caller     *CallSite // nil for root frames
+		name, file string
+	}
+	total := 0
+	// Merging may make more call sites siblings, so repeat until nothing changes.
+	for {
+		rep := make(map[*CallSite]*CallSite) // union-find parent links
+		var find func(site *CallSite) *CallSite
+		find = func(site *CallSite) *CallSite {
+			if r, ok := rep[site]; ok && r != site {
+				r = find(r)
+				rep[site] = r
+				return r
+			}
+			return site
+		}
+		first := make(map[siblingKey]*CallSite)
+		merged := 0
+		for trace := range traces {
+			for i, site := range trace.Stack {
+				if site.Synthetic {
+					continue
+				}
+				key := siblingKey{name: site.Name, file: site.Filename}
+				if i+1 < len(trace.Stack) {
+					key.caller = trace.Stack[i+1]
+				}
+				other, ok := first[key]
+				if !ok {
+					first[key] = site
+					continue
+				}
+				if r1, r2 := find(other), find(site); r1 != r2 {
+					rep[r2] = r1
+					merged++
+				}
+			}
+		}
+		if merged == 0 {
+			return total
+		}
+		total += merged
+		MergeCallSites(traces, func(site *CallSite) string {
+			return fmt.Sprintf("%p", find(site))
+		})
+	}
+}
+
+// cumulativeCounts returns the number of samples in traces whose stacks include each CallSite.
+func cumulativeCounts(traces map[*Trace]bool) map[*CallSite]int {
+	counts := make(map[*CallSite]int)
+	for trace := range traces {
+		seen := make(map[*CallSite]bool)
+		for _, site := range trace.Stack {
+			if !seen[site] {
+				counts[site] += trace.Count
+				seen[site] = true
+			}
+		}
+	}
+	return counts
+}
+
+// CollapseBelow folds the call sites sampled in at most t times the sample count (cumulatively) into a
+// synthetic "[other]" call site per caller. In each stack, the outermost such call site and everything it
+// calls are replaced by the "[other]" child of its caller, so all samples are retained. A caller's
+// sub-threshold callees are only folded if there are at least two of them. traces are not changed:
+// CollapseBelow returns a new set in which the changed traces are replaced by collapsed copies, along with the
+// number of traces that were changed.
+func CollapseBelow(traces map[*Trace]bool, t float64) (map[*Trace]bool, int) {
+	min := int(t * float64(CountSum(traces)))
+	cumulative := cumulativeCounts(traces)
+
+	// outermostSmall gives the index of the outermost sub-threshold call site in a stack, or -1.
+	outermostSmall := func(stack []*CallSite) int {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if cumulative[stack[i]] <= min {
+				return i
+			}
+		}
+		return -1
+	}
+	caller := func(stack []*CallSite, i int) *CallSite {
+		if i+1 < len(stack) {
+			return stack[i+1]
+		}
+		return nil // i is the root
+	}
+
+	smallCallees := make(map[*CallSite]map[*CallSite]bool) // by caller
+	for trace := range traces {
+		i := outermostSmall(trace.Stack)
+		if i < 0 {
+			continue
+		}
+		c := caller(trace.Stack, i)
+		if smallCallees[c] == nil {
+			smallCallees[c] = make(map[*CallSite]bool)
 		}
+		smallCallees[c][trace.Stack[i]] = true
 	}
+
+	collapsed := make(map[*Trace]bool, len(traces))
+	others := make(map[*CallSite]*CallSite) // by caller
+	changed := 0
+	for trace := range traces {
+		i := outermostSmall(trace.Stack)
+		if i < 0 {
+			collapsed[trace] = true
+			continue
+		}
+		c := caller(trace.Stack, i)
+		if len(smallCallees[c]) < 2 {
+			collapsed[trace] = true
+			continue
+		}
+		other, ok := others[c]
+		if !ok {
+			other = &CallSite{Name: "[other]", Synthetic: true, LineNumber: -1}
+			others[c] = other
+		}
+		stack := make([]*CallSite, 0, len(trace.Stack)-i)
+		stack = append(stack, other)
+		copied := *trace
+		copied.Stack = append(stack, trace.Stack[i+1:]...)
+		collapsed[&copied] = true
+		changed++
+	}
+	return collapsed, changed
 }
 
 // A Node may represent a collapsed chain of multiple calls.
@@ -63,25 +893,46 @@ type Node struct {
 
 // CreateNodes creates a new Node for each CallSite and hooks them together with weighted edges. It also
 // attaches counts to CallSites from the Trace they were in.
-func CreateNodes(traces map[*Trace]bool) []*Node {
+//
+// If decay is positive, the samples of a trace count toward the cumulative count of the frame i levels above
+// its leaf (and toward the weight of the edge below that frame) as decay^i samples, rounded. This
+// de-emphasizes deep framework frames for visual effect; the resulting counts are not a faithful attribution
+// of time. Self counts are always exact.
+func CreateNodes(traces map[*Trace]bool, decay float64) []*Node {
 	nodes := make(map[*CallSite]*Node)
-	for trace := range traces {
+	var nodeList []*Node // in order of creation, for deterministic output
+	for _, trace := range SortedTraces(traces) {
+		// With recursion, a node (or edge) may occur several times in one stack. Like pprof, count each
+		// trace's samples only once toward a node's cumulative count or an edge's weight.
+		seenNodes := make(map[*Node]bool)
+		seenEdges := make(map[[2]*Node]bool)
 		var child *Node
+		count := trace.Count
 		for i, site := range trace.Stack {
+			if decay > 0 && i > 0 {
+				count = int(math.Floor(float64(trace.Count)*math.Pow(decay, float64(i)) + 0.5))
+			}
 			node, ok := nodes[site]
 			if !ok {
 				node = &Node{CallSite: site}
+				// The CallSite may have been counted before, for another set of traces.
+				site.Count, site.CumulativeCount = 0, 0
 				nodes[site] = node
+				nodeList = append(nodeList, node)
 			}
 			if i == 0 {
 				node.Count += trace.Count
 			}
-			node.CumulativeCount += trace.Count
-			if child != nil {
+			if !seenNodes[node] {
+				node.CumulativeCount += count
+				seenNodes[node] = true
+			}
+			if child != nil && !seenEdges[[2]*Node{node, child}] {
+				seenEdges[[2]*Node{node, child}] = true
 				if node.EdgeWeights == nil {
 					node.EdgeWeights = make(map[*Node]int)
 				}
-				node.EdgeWeights[child] += trace.Count
+				node.EdgeWeights[child] += count
 				if child.BackLinks == nil {
 					child.BackLinks = make(map[*Node]bool)
 				}
@@ -90,11 +941,35 @@ func CreateNodes(traces map[*Trace]bool) []*Node {
 			child = node
 		}
 	}
-	var nodeList []*Node
+	return nodeList
+}
+
+// CheckSelfCounts verifies that the self counts of nodes add up to total, the number of samples in the traces
+// they were created from. Each sample is attributed to exactly one leaf, so any difference indicates an
+// accounting bug.
+func CheckSelfCounts(nodes []*Node, total int) error {
+	sum := 0
 	for _, node := range nodes {
-		nodeList = append(nodeList, node)
+		sum += node.Count
 	}
-	return nodeList
+	if sum != total {
+		return fmt.Errorf("node self counts sum to %d but the traces contain %d samples (off by %d)",
+			sum, total, sum-total)
+	}
+	return nil
+}
+
+// CheckCumulativeCounts verifies that the cumulative count of each of nodes is at least its self count and at
+// most total, the number of samples in the traces they were created from. A cumulative count above total means
+// that some trace was counted more than once toward the node, as can happen with recursion.
+func CheckCumulativeCounts(nodes []*Node, total int) error {
+	for _, node := range nodes {
+		if node.CumulativeCount < node.Count || node.CumulativeCount > total {
+			return fmt.Errorf("%s has a cumulative count of %d, but it should be between its self count (%d) "+
+				"and the sample total (%d)", node.CallSite, node.CumulativeCount, node.Count, total)
+		}
+	}
+	return nil
 }
 
 func FilterThreshold(nodes []*Node, t float64) []*Node {
@@ -103,18 +978,49 @@ func FilterThreshold(nodes []*Node, t float64) []*Node {
 		totalCount += node.Count
 	}
 	min := int(t * float64(totalCount))
+	return FilterNodes(nodes, func(node *Node) bool {
+		return node.CumulativeCount > min
+	})
+}
 
-	highCountNodes := make(map[*Node]bool)
+// FilterMinSelfCum removes the nodes whose self or cumulative sample counts are below the given ratios of
+// totalCount, the sample count before any nodes were removed. A ratio of 0 disables that threshold. If both
+// are enabled, a node is removed if it fails both of them or, if strict is true, either of them.
+func FilterMinSelfCum(nodes []*Node, totalCount int, minSelf, minCum float64, strict bool) []*Node {
+	total := float64(totalCount)
+	return FilterNodes(nodes, func(node *Node) bool {
+		var passed []bool
+		if minSelf > 0 {
+			passed = append(passed, float64(node.Count) >= minSelf*total)
+		}
+		if minCum > 0 {
+			passed = append(passed, float64(node.CumulativeCount) >= minCum*total)
+		}
+		if len(passed) == 0 {
+			return true
+		}
+		for _, p := range passed {
+			if p != strict {
+				return p
+			}
+		}
+		return strict
+	})
+}
+
+// FilterNodes returns the nodes for which keep returns true, removing the edges to the others.
+func FilterNodes(nodes []*Node, keep func(*Node) bool) []*Node {
+	kept := make(map[*Node]bool)
 	for _, node := range nodes {
-		if node.CumulativeCount > min {
-			highCountNodes[node] = true
+		if keep(node) {
+			kept[node] = true
 		}
 	}
 
 	// Clean up edges
-	for node := range highCountNodes {
+	for node := range kept {
 		for child := range node.EdgeWeights {
-			if !highCountNodes[child] {
+			if !kept[child] {
 				delete(node.EdgeWeights, child)
 			}
 		}
@@ -123,15 +1029,12 @@ func FilterThreshold(nodes []*Node, t float64) []*Node {
 		}
 	}
 
-	newTotal := 0
 	var newNodes []*Node
-	for node := range highCountNodes {
-		newNodes = append(newNodes, node)
-		newTotal += node.Count
+	for _, node := range nodes {
+		if kept[node] {
+			newNodes = append(newNodes, node)
+		}
 	}
-
-	fmt.Printf("Removed %d nodes below threshold of %.1f%% (%d)\n", len(nodes)-len(newNodes), t*100, min)
-
 	return newNodes
 }
 
@@ -147,50 +1050,599 @@ func frac(p, q int) string {
 	return fmt.Sprintf("%d/%d (%.2f%%)", p, q, 100*float64(p)/float64(q))
 }
 
+// FilterTraces applies the trace-level filters in opts to traces.
+func FilterTraces(traces map[*Trace]bool, opts Options) {
+	if opts.StripArgs {
+		StripArgs(traces)
+	}
+	if key := granularities[opts.Granularity]; key != nil {
+		MergeCallSites(traces, key)
+	}
+	if opts.MergeUnknown != "none" {
+		frames := MergeUnknown(traces, opts.MergeUnknown == "method")
+		opts.infof("Merged %d frames without source information\n", frames)
+	}
+	if opts.FoldLeafRecursion {
+		opts.infof("Folded leaf recursion in %d traces\n", FoldLeafRecursion(traces))
+	}
+	if opts.KeepFrames != nil {
+		countBefore := CountSum(traces)
+		frames, removed := TrimFrames(traces, func(site *CallSite) bool {
+			return opts.KeepFrames.MatchString(site.Name)
+		})
+		opts.infof("Removed %d frames not matching -keep-frames (and %d traces with no matching frames)\n",
+			frames, removed)
+		opts.infof("Keeping %s of samples after trimming frames\n", frac(CountSum(traces), countBefore))
+	}
+	if !opts.KeepNative {
+		frames, removed := TrimFrames(traces, func(site *CallSite) bool { return !isNative(site) })
+		opts.infof("Removed %d native method frames (and %d traces with only native frames)\n", frames, removed)
+	}
+	if opts.ExcludeGenerated != nil {
+		frames, removed := TrimFrames(traces, func(site *CallSite) bool {
+			return !opts.ExcludeGenerated.MatchString(site.Name)
+		})
+		opts.infof("Removed %d generated frames (and %d traces with only generated frames)\n", frames, removed)
+	}
+	if opts.RootAt != nil {
+		countBefore := CountSum(traces)
+		RerootAt(traces, opts.RootAt)
+		opts.infof("Keeping %s of samples after re-rooting at frames matching -root-at\n",
+			frac(CountSum(traces), countBefore))
+	}
+	// Excluding comes before -topk, so that the top traces are chosen from those that are left.
+	if opts.Exclude != nil {
+		countBefore := CountSum(traces)
+		FilterExcluding(traces, opts.Exclude, opts.RegexAny, opts.RegexFilename)
+		opts.infof("Keeping %s of samples after -exclude\n", frac(CountSum(traces), countBefore))
+	}
+	if opts.TopK > 0 {
+		countBefore := CountSum(traces)
+		FilterTopK(traces, opts.TopK)
+		opts.infof("Keeping %s of samples after filtering top %d most frequently sampled\n",
+			frac(CountSum(traces), countBefore), opts.TopK)
+	}
+	if opts.Regex != nil {
+		countBefore := CountSum(traces)
+		FilterMatching(traces, opts.Regex, opts.RegexAny, opts.RegexFilename)
+		opts.infof("Keeping %s of samples after filtering matching samples\n",
+			frac(CountSum(traces), countBefore))
+	}
+	if opts.CombineSiblings {
+		opts.infof("Merged %d call sites into a same-named sibling\n", CombineSiblings(traces))
+	}
+}
+
+// BuildNodes creates the graph of Nodes for traces and applies the node-level filters in opts.
+func BuildNodes(traces map[*Trace]bool, opts Options) []*Node {
+	if opts.CollapseBelow > 0 {
+		var changed int
+		traces, changed = CollapseBelow(traces, opts.CollapseBelow)
+		opts.infof("Collapsed call sites below %.1f%% into [other] nodes in %d traces\n",
+			opts.CollapseBelow*100, changed)
+	}
+	nodes := CreateNodes(traces, opts.DepthDecay)
+	if opts.DepthDecay > 0 {
+		log.Printf("Warning: -weight-by-depth is experimental: cumulative counts and edge weights are decayed "+
+			"by %g per level and do not reflect actual time", opts.DepthDecay)
+	}
+	if opts.Verbose {
+		if err := CheckSelfCounts(nodes, CountSum(traces)); err != nil {
+			log.Println("Warning:", err)
+		}
+		if err := CheckCumulativeCounts(nodes, CountSum(traces)); err != nil {
+			log.Println("Warning:", err)
+		}
+	}
+	before := len(nodes)
+	nodes = FilterThreshold(nodes, opts.Threshold)
+	opts.infof("Removed %d nodes below threshold of %.1f%% (%d)\n",
+		before-len(nodes), opts.Threshold*100, int(opts.Threshold*float64(CountSum(traces))))
+	if opts.MinSelf > 0 || opts.MinCum > 0 {
+		before := len(nodes)
+		nodes = FilterMinSelfCum(nodes, CountSum(traces), opts.MinSelf, opts.MinCum, opts.MinMode == "either")
+		opts.infof("Removed %d nodes below -min-self %.1f%% / -min-cum %.1f%% (failing %s)\n",
+			before-len(nodes), opts.MinSelf*100, opts.MinCum*100, opts.MinMode)
+	}
+	if opts.MinEdgeWeight > 0 {
+		min := int(opts.MinEdgeWeight * float64(CountSum(traces)))
+		removed := PruneEdges(nodes, min)
+		opts.infof("Removed %d edges below %.1f%% (%d), keeping each node connected to a root\n",
+			removed, opts.MinEdgeWeight*100, min)
+	}
+	if opts.EdgeCountMin > 0 {
+		removed := DropLightEdges(nodes, opts.EdgeCountMin)
+		opts.infof("Removed %d edges with fewer than %d samples\n", removed, opts.EdgeCountMin)
+	}
+
+	opts.infof("%d nodes for rendering\n", len(nodes))
+	if opts.GraphStats {
+		stats := GraphStats(nodes)
+		opts.infof("Graph: %d nodes, %d edges, %d roots, %d leaves, max depth %d, cyclic: %t\n",
+			stats.Nodes, stats.Edges, stats.Roots, stats.Leaves, stats.MaxDepth, stats.Cyclic)
+	}
+	return nodes
+}
+
+// WriteOutput renders traces to w in the format selected by opts.
+func WriteOutput(w io.Writer, traces map[*Trace]bool, opts Options) error {
+	start := time.Now()
+	switch opts.Format {
+	case "treemap-json":
+		tree := BuildTree(traces)
+		PruneTree(tree, opts.Threshold)
+		logTiming(opts, "Building the tree", start)
+		start = time.Now()
+		defer logTiming(opts, "Rendering", start)
+		return WriteTreemapJSON(w, tree)
+	case "graphml":
+		nodes := BuildNodes(traces, opts)
+		logTiming(opts, "Building the graph", start)
+		start = time.Now()
+		defer logTiming(opts, "Rendering", start)
+		return WriteGraphML(w, nodes)
+	case "html":
+		nodes := BuildNodes(traces, opts)
+		logTiming(opts, "Building the graph", start)
+		start = time.Now()
+		defer logTiming(opts, "Rendering", start)
+		return WriteHTMLReport(w, traces, nodes, opts)
+	case "csv":
+		nodes := BuildNodes(traces, opts)
+		logTiming(opts, "Building the graph", start)
+		start = time.Now()
+		defer logTiming(opts, "Rendering", start)
+		return WriteCSV(w, nodes, opts.ProfileTotal)
+	case "folded":
+		defer logTiming(opts, "Rendering", start)
+		return WriteFolded(w, traces, opts.FoldedLines)
+	case "pprof":
+		defer logTiming(opts, "Rendering", start)
+		return WritePprof(w, traces)
+	default:
+		nodes := BuildNodes(traces, opts)
+		logTiming(opts, "Building the graph", start)
+		start = time.Now()
+		defer logTiming(opts, "Rendering", start)
+		return WriteDotFormat(w, nodes, opts)
+	}
+}
+
+// infof prints an informational message, unless in quiet mode. Messages go to stdout, unless the output
+// itself is written there (see InfoStderr).
+func (opts Options) infof(format string, args ...interface{}) {
+	if opts.Quiet {
+		return
+	}
+	w := os.Stdout
+	if opts.InfoStderr {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, opts.InfoPrefix+format, args...)
+}
+
+// logTiming reports the time since start taken by a stage of processing, in verbose mode.
+func logTiming(opts Options, stage string, start time.Time) {
+	if opts.Verbose {
+		fmt.Fprintf(os.Stderr, "%s took %s\n", stage, time.Since(start))
+	}
+}
+
+func parseTar(r io.Reader, opts Options) (map[*Trace]bool, error) {
+	traces, members, err := ParseTar(r, opts.TarGlob, opts.Parse)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("No members of %s match %q.", opts.Filename, opts.TarGlob)
+	}
+	opts.infof("Parsed %d archive members:\n", len(members))
+	for _, member := range members {
+		opts.infof("  %s\n", member)
+	}
+	if opts.MergeThreshold > 0 {
+		dropped := DropRareTraces(traces, opts.MergeThreshold)
+		opts.infof("Dropped %d merged traces with fewer than %d samples\n", dropped, opts.MergeThreshold)
+	}
+	return traces, nil
+}
+
+// traceIDs holds the values of the repeatable -trace-id flag.
+var traceIDs intList
+
+func init() {
+	flag.Var(&traceIDs, "trace-id", "Only keep the trace with this ID (may be repeated)")
+}
+
+// An intList is a flag.Value collecting the integers given by repeating a flag.
+type intList []int
+
+func (l *intList) String() string { return fmt.Sprint([]int(*l)) }
+
+func (l *intList) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("not an integer: %q", s)
+	}
+	*l = append(*l, n)
+	return nil
+}
+
 func main() {
 	flag.Parse()
-	if *topk > 0 && *regex != "" {
-		log.Fatal("Cannot provide both -topk and -regexp.")
-	}
 	flag.Usage = func() {
-		fmt.Println("Usage: hprofviz [OPTIONS] HPROF_FILE.txt OUTPUT_FILE.dot\nwhere OPTIONS are:")
+		fmt.Println("Usage: hprofviz [OPTIONS] [HPROF_FILE.txt] OUTPUT_FILE.dot\n" +
+			"       hprofviz -output-dir DIR [OPTIONS] HPROF_FILE.txt...\n" +
+			"       hprofviz -chunks GLOB [OPTIONS] OUTPUT_FILE.dot\n" +
+			"       hprofviz -list-traces|-summary [OPTIONS] [HPROF_FILE.txt]\n" +
+			"An input of - (or no input) is read from stdin, and an output of - is written to stdout.\n" +
+			"where OPTIONS are:")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	if flag.NArg() != 2 {
+	opts, err := optionsFromFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+	textMode := ""
+	for _, m := range []struct {
+		name string
+		set  bool
+	}{
+		{"-list-traces", opts.ListTraces},
+		{"-list-frames", opts.ListFrames},
+		{"-summary", opts.Summary},
+	} {
+		if !m.set {
+			continue
+		}
+		if textMode != "" {
+			log.Fatalf("Cannot provide both %s and %s.", textMode, m.name)
+		}
+		textMode = m.name
+	}
+	if opts.Threads && textMode != "" {
+		log.Fatalf("Cannot provide both -threads and %s.", textMode)
+	}
+	if *outputDir != "" {
+		if opts.Chunks {
+			log.Fatal("Cannot provide both -output-dir and -chunks.")
+		}
+		if textMode != "" {
+			log.Fatalf("Cannot provide both -output-dir and %s.", textMode)
+		}
+		if flag.NArg() == 0 {
+			flag.Usage()
+		}
+		outputs, err := outputDirNames(*outputDir, flag.Args(), opts.Format)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// pprof profiles are always gzipped.
+		if opts.OutputGzip || opts.Format == "pprof" {
+			for i := range outputs {
+				outputs[i] += ".gz"
+			}
+		}
+		if err := os.MkdirAll(*outputDir, 0755); err != nil {
+			log.Fatal(err)
+		}
+		if *concurrency < 1 {
+			log.Fatal("-concurrency must be at least 1.")
+		}
+		// Each parse holds a whole profile in memory, so only parse a bounded number of inputs at once.
+		// An input that fails doesn't stop the others.
+		start := time.Now()
+		sem := make(chan struct{}, *concurrency)
+		var wg sync.WaitGroup
+		errs := make([]error, flag.NArg())
+		for i, input := range flag.Args() {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, input, output string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				inputOpts := opts
+				inputOpts.InfoPrefix = input + ": "
+				errs[i] = render(input, output, inputOpts)
+			}(i, input, outputs[i])
+		}
+		wg.Wait()
+		failed := 0
+		for i, err := range errs {
+			if err != nil {
+				log.Printf("%s: %s", flag.Arg(i), err)
+				failed++
+			}
+		}
+		opts.infof("Rendered %d of %d inputs in %s\n", flag.NArg()-failed, flag.NArg(), time.Since(start))
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+	nargs := 2
+	if textMode != "" {
+		nargs = 1
+	}
+	if opts.Chunks {
+		if opts.Tar {
+			log.Fatal("Cannot provide both -chunks and -tar.")
+		}
+		// The chunks take the place of the input file.
+		if flag.NArg() != nargs-1 {
+			flag.Usage()
+		}
+		if err := render(*chunks, flag.Arg(0), opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	args := flag.Args()
+	switch len(args) {
+	case nargs:
+	case nargs - 1:
+		args = append([]string{"-"}, args...)
+	default:
 		flag.Usage()
 	}
-	filename := flag.Arg(0)
-	traces := ParseHProfFile(filename)
+	output := ""
+	if nargs == 2 {
+		output = args[1]
+	}
+	if output == "-" && opts.Threads {
+		log.Fatal("Cannot write -threads output to stdout (give an output file name).")
+	}
+	if err := render(args[0], output, opts); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	if *topk > 0 {
-		countBefore := CountSum(traces)
-		FilterTopK(traces, *topk)
-		fmt.Printf("Keeping %s of samples after filtering top %d most frequently sampled\n",
-			frac(CountSum(traces), countBefore), *topk)
+// render reads the profile in the input file and renders it to the output file (see renderTraces) or, with
+// -threads, to one output file per thread.
+func render(input, output string, opts Options) error {
+	// Keep stdout for the output or, with -list-traces, -list-frames, or -summary, what they print, so that it
+	// can be piped.
+	if output == "-" || opts.ListTraces || opts.ListFrames || opts.Summary {
+		opts.InfoStderr = true
 	}
-	if *regex != "" {
-		reg, err := regexp.Compile(*regex)
+	opts.Filename = input
+	if input == "-" {
+		opts.Filename = "stdin"
+	}
+	var f io.ReadCloser
+	var err error
+	if opts.Chunks {
+		f, err = openChunks(input)
+	} else {
+		f, err = infile.Open(input)
+	}
+	if err != nil {
+		return err
+	}
+	if f != os.Stdin {
+		defer f.Close()
+	}
+	// Chunks are decompressed individually by openChunks.
+	var r io.Reader = f
+	if !opts.Chunks {
+		if r, err = infile.MaybeGunzip(f); err != nil {
+			return fmt.Errorf("Cannot read %s: %s", opts.Filename, err)
+		}
+	}
+	start := time.Now()
+	in := &infile.CountingReader{R: r}
+	var traces map[*Trace]bool
+	var threadTable map[int]*Thread
+	interval := opts.SampleInterval
+	if opts.Tar {
+		if traces, err = parseTar(in, opts); err != nil {
+			return err
+		}
+	} else {
+		profile, err := ParseProfile(in, opts.Parse)
 		if err != nil {
-			log.Fatal(err)
+			return err
+		}
+		traces = profile.Traces
+		threadTable = profile.Threads
+		if interval == 0 {
+			interval = profile.Interval
+		}
+		if opts.Utilization || opts.Verbose {
+			if u, ok := Utilization(profile, interval); ok {
+				opts.infof("Sampled CPU time is %.2fx the wall time profiled\n", u)
+			} else if opts.Utilization {
+				opts.infof("Cannot compute utilization: the dump lacks timestamps or a sampling interval\n")
+			}
+		}
+	}
+	if CountSum(traces) == 0 {
+		return fmt.Errorf("No CPU sample data found in %s (was hprof run with cpu=samples?). "+
+			"For binary heap dumps, use hprofbin instead.", opts.Filename)
+	}
+	if opts.Verbose {
+		elapsed := time.Since(start)
+		fmt.Fprintf(os.Stderr, "Parsing %d bytes took %s (%.1f MB/s)\n",
+			in.N, elapsed, float64(in.N)/1e6/elapsed.Seconds())
+	}
+	if opts.ValidateStacks {
+		for _, problem := range ValidateStacks(traces) {
+			log.Println("Warning:", problem)
 		}
+	}
+	if len(opts.TraceIDs) > 0 {
 		countBefore := CountSum(traces)
-		FilterMatching(traces, reg)
-		fmt.Printf("Keeping %s of samples after filtering matching samples\n",
-			frac(CountSum(traces), countBefore))
+		if err := FilterTraceIDs(traces, opts.TraceIDs); err != nil {
+			return err
+		}
+		opts.infof("Keeping %s of samples in the %d traces selected by -trace-id\n",
+			frac(CountSum(traces), countBefore), len(traces))
 	}
+	if opts.HashNames {
+		HashNames(traces, opts.HashLines)
+	}
+	if opts.Threads {
+		groups := PartitionByThread(traces, opts.ThreadsTopN)
+		if len(groups) == 1 && groups[0].Threads[0] == 0 {
+			return fmt.Errorf("No thread information found in %s (was hprof run with thread=y?)", input)
+		}
+		for _, g := range groups {
+			if g.Name == "other-threads" {
+				opts.infof("Lumping %d threads with fewer samples into %s\n", len(g.Threads), g.Name)
+				if opts.Verbose {
+					fmt.Fprintf(os.Stderr, "Lumped threads: %v\n", g.Threads)
+				}
+			}
+			threadOpts := opts
+			label := g.Name
+			if t, ok := threadTable[g.Threads[0]]; ok && g.Name != "other-threads" {
+				label += ": " + t.Name
+			}
+			threadOpts.Filename = fmt.Sprintf("%s (%s)", input, label)
+			if err := renderTraces(g.Traces, threadOutputName(output, g), interval, threadOpts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return renderTraces(traces, output, interval, opts)
+}
 
-	nodes := CreateNodes(traces)
-	nodes = FilterThreshold(nodes, *threshold)
-
-	fmt.Printf("%d nodes for rendering\n", len(nodes))
+// renderTraces filters traces and writes the graph to the output file (or, with -list-traces, prints the
+// filtered traces).
+func renderTraces(traces map[*Trace]bool, output string, interval time.Duration, opts Options) error {
+	opts.ProfileTotal = CountSum(traces)
+	FilterTraces(traces, opts)
+	if interval > 0 {
+		opts.infof("Samples represent about %s of CPU time (sampling interval %s)\n",
+			time.Duration(CountSum(traces))*interval, interval)
+	}
+	if opts.ListTraces {
+		order := SortedTraces
+		if opts.KeepOrder {
+			order = TracesInFileOrder
+		}
+		for _, trace := range order(traces) {
+			fmt.Print(trace)
+		}
+		return nil
+	}
+	if opts.ListFrames {
+		for _, site := range DistinctFrames(traces) {
+			lineNumber := "???"
+			if site.LineNumber > 0 {
+				lineNumber = strconv.Itoa(site.LineNumber)
+			}
+			fmt.Printf("%s\t%s\t%s\n", site.Name, site.Filename, lineNumber)
+		}
+		return nil
+	}
+	if opts.Summary {
+		printSummary(traces)
+		return nil
+	}
 
-	f, err := os.Create(flag.Arg(1))
+	compress := opts.OutputGzip || strings.HasSuffix(output, ".gz") || opts.Format == "pprof"
+	out, err := createOutput(output, compress)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer f.Close()
-	if err := WriteDotFormat(f, filename, nodes); err != nil {
-		log.Fatal(err)
+	if err := WriteOutput(out.Writer(), traces, opts); err != nil {
+		out.Abort()
+		return err
+	}
+	return out.Commit()
+}
+
+// Utilization returns the ratio of the sampled CPU time (the sample count times interval) to the wall time
+// from the start of profiling until the samples were dumped. Because hprof samples all running threads, this
+// may exceed 1 on a multicore machine. Utilization returns false if the timing information is unavailable.
+func Utilization(profile *Profile, interval time.Duration) (float64, bool) {
+	if interval <= 0 || profile.Created.IsZero() || profile.Timestamp.IsZero() {
+		return 0, false
+	}
+	wall := profile.Timestamp.Sub(profile.Created)
+	if wall <= 0 {
+		return 0, false
+	}
+	cpu := time.Duration(CountSum(profile.Traces)) * interval
+	return float64(cpu) / float64(wall), true
+}
+
+// DistinctFrames returns the distinct call sites (by name, filename, and line number) in the stacks of
+// traces, sorted by name, then filename, then line number.
+func DistinctFrames(traces map[*Trace]bool) []*CallSite {
+	type frameKey struct {
+		name, filename string
+		line           int
+	}
+	seen := make(map[frameKey]bool)
+	var sites []*CallSite
+	for trace := range traces {
+		for _, site := range trace.Stack {
+			k := frameKey{site.Name, site.Filename, site.LineNumber}
+			if !seen[k] {
+				seen[k] = true
+				sites = append(sites, site)
+			}
+		}
+	}
+	sort.Slice(sites, func(i, j int) bool { return lessCallSite(sites[i], sites[j]) })
+	return sites
+}
+
+// printSummary prints a short digest of traces: the sample count, the deepest stack, and the call sites with
+// the most self and cumulative samples.
+func printSummary(traces map[*Trace]bool) {
+	const n = 10
+	total := CountSum(traces)
+	depth := 0
+	for trace := range traces {
+		if len(trace.Stack) > depth {
+			depth = len(trace.Stack)
+		}
+	}
+	nodes := CreateNodes(traces, 0)
+	fmt.Printf("%d samples in %d traces; max stack depth %d\n", total, len(traces), depth)
+	fmt.Printf("Top %d by self samples:\n", n)
+	for _, node := range TopLeaves(nodes, n) {
+		if node.Count == 0 {
+			break
+		}
+		fmt.Printf("  %6d %6.2f%%  %s\n", node.Count, 100*float64(node.Count)/float64(total), node.CallSite)
+	}
+	fmt.Printf("Top %d by cumulative samples:\n", n)
+	for _, node := range TopCumulative(nodes, n) {
+		fmt.Printf("  %6d %6.2f%%  %s\n", node.CumulativeCount,
+			100*float64(node.CumulativeCount)/float64(total), node.CallSite)
+	}
+}
+
+// formatExtensions are the output file extensions used with -output-dir.
+var formatExtensions = map[string]string{
+	"dot":          ".dot",
+	"treemap-json": ".json",
+	"graphml":      ".graphml",
+	"html":         ".html",
+	"csv":          ".csv",
+	"folded":       ".folded",
+	"pprof":        ".pb",
+}
+
+// outputDirNames returns the output path in dir for each input: the input's base name, with its extension
+// replaced by the one for format. It is an error for two inputs to map to the same output.
+func outputDirNames(dir string, inputs []string, format string) ([]string, error) {
+	outputs := make([]string, len(inputs))
+	seen := make(map[string]string)
+	for i, input := range inputs {
+		base := strings.TrimSuffix(filepath.Base(input), ".gz")
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+		outputs[i] = filepath.Join(dir, base+formatExtensions[format])
+		if other, ok := seen[outputs[i]]; ok {
+			return nil, fmt.Errorf("Inputs %s and %s would both be written to %s.", other, input, outputs[i])
+		}
+		seen[outputs[i]] = input
 	}
+	return outputs, nil
 }
@@ -0,0 +1,816 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testTraces builds traces from specs such as "5 c b a", a trace with 5 samples whose stack is c called by b
+// called by a. Frames are call sites in Name.java named by the given names, which may have a line number
+// suffix (as in "b:12"; the default is line 1). Equal frames share a call site. The traces are given IDs and
+// file order by their position in specs.
+func testTraces(specs ...string) map[*Trace]bool {
+	sites := make(map[string]*CallSite)
+	traces := make(map[*Trace]bool)
+	for i, spec := range specs {
+		fields := strings.Fields(spec)
+		count, err := strconv.Atoi(fields[0])
+		if err != nil {
+			panic(err)
+		}
+		trace := &Trace{ID: i + 1, Seq: i, Count: count}
+		for _, frame := range fields[1:] {
+			site, ok := sites[frame]
+			if !ok {
+				name, line := frame, 1
+				if j := strings.IndexByte(frame, ':'); j >= 0 {
+					name = frame[:j]
+					if line, err = strconv.Atoi(frame[j+1:]); err != nil {
+						panic(err)
+					}
+				}
+				site = &CallSite{Name: name, Filename: name + ".java", LineNumber: line}
+				sites[frame] = site
+			}
+			trace.Stack = append(trace.Stack, site)
+		}
+		traces[trace] = true
+	}
+	return traces
+}
+
+// stacks describes traces in the form given to testTraces, in file order, for comparing them.
+func stacks(traces map[*Trace]bool) []string {
+	var specs []string
+	for _, trace := range TracesInFileOrder(traces) {
+		spec := strconv.Itoa(trace.Count)
+		for _, site := range trace.Stack {
+			spec += " " + site.Name
+			if site.LineNumber != 1 {
+				spec += ":" + strconv.Itoa(site.LineNumber)
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// nodeByName returns the node for the call site named name, or nil.
+func nodeByName(nodes []*Node, name string) *Node {
+	for _, node := range nodes {
+		if node.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// captureOutput runs f with os.Stdout and os.Stderr redirected, returning what it wrote to each.
+func captureOutput(t *testing.T, f func()) (stdout, stderr string) {
+	t.Helper()
+	capture := func(file **os.File) func() string {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := *file
+		*file = w
+		done := make(chan string)
+		go func() {
+			b, _ := io.ReadAll(r)
+			r.Close()
+			done <- string(b)
+		}()
+		return func() string {
+			*file = saved
+			w.Close()
+			return <-done
+		}
+	}
+	restoreStdout := capture(&os.Stdout)
+	restoreStderr := capture(&os.Stderr)
+	defer func() { stdout, stderr = restoreStdout(), restoreStderr() }()
+	f()
+	return
+}
+
+// trickyName is a method name with characters that need escaping in the output formats.
+const trickyName = `com.example.Map<K,V>."get"&set`
+
+// sampleTraces parses testdata/sample.txt, renaming com.example.Bar.compute, its hottest method, to trickyName.
+func sampleTraces(t *testing.T) map[*Trace]bool {
+	t.Helper()
+	traces := parseFile(t, "sample.txt", ParseOptions{}).Traces
+	for trace := range traces {
+		for _, site := range trace.Stack {
+			if site.Name == "com.example.Bar.compute" {
+				site.Name = trickyName
+			}
+		}
+	}
+	return traces
+}
+
+// testOptions returns Options that leave traces as they are, for tests to change.
+func testOptions() Options {
+	return Options{MergeUnknown: "none", KeepNative: true, Quiet: true}
+}
+
+func TestFilterTopK(t *testing.T) {
+	traces := testTraces("5 a", "3 b a", "1 c a")
+	FilterTopK(traces, 100)
+	if len(traces) != 3 {
+		t.Errorf("with k larger than the number of traces: got %d traces; want all 3", len(traces))
+	}
+	FilterTopK(traces, 2)
+	if got := strings.Join(stacks(traces), ", "); got != "5 a, 3 b a" {
+		t.Errorf("with k = 2: got traces %s; want the two largest", got)
+	}
+}
+
+func TestFilterTracesExclude(t *testing.T) {
+	traces := testTraces("5 lock run main", "3 compute run main", "2 lock wait main")
+	opts := testOptions()
+	opts.Regex = regexp.MustCompile("^(lock|compute)$")
+	opts.Exclude = regexp.MustCompile("^lock$")
+	FilterTraces(traces, opts)
+	// The traces sampled in lock match both; -exclude wins.
+	if got := strings.Join(stacks(traces), ", "); got != "3 compute run main" {
+		t.Errorf("got traces %s; want only the compute trace", got)
+	}
+
+	traces = testTraces("5 lock run main", "3 compute run main", "2 lock wait main")
+	opts.RegexAny = true
+	opts.Regex = regexp.MustCompile("^wait$")
+	FilterTraces(traces, opts)
+	if len(traces) != 0 {
+		t.Errorf("with -regex-match any: got traces %s; want none", strings.Join(stacks(traces), ", "))
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	dir := t.TempDir()
+	opts := testOptions()
+	opts.Format = "dot"
+	output := filepath.Join(dir, "out.dot")
+
+	err := render(filepath.Join("testdata", "missing.txt"), output, opts)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("rendering a missing input: got error %v; want one wrapping fs.ErrNotExist", err)
+	}
+	bad := filepath.Join(dir, "bad.txt")
+	if err := os.WriteFile(bad, []byte("TRACE 1:\n\tnot a frame\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var perr *ParseError
+	if err := render(bad, output, opts); !errors.As(err, &perr) || perr.Line != 2 {
+		t.Errorf("rendering a bad input: got error %v; want a *ParseError for line 2", err)
+	}
+	if _, err := os.Stat(output); err == nil {
+		t.Error("failed renders wrote an output file")
+	}
+
+	if err := render(filepath.Join("testdata", "sample.txt"), output, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Errorf("rendering sample.txt: %s", err)
+	}
+}
+
+func TestBuildNodesEdgeCountMin(t *testing.T) {
+	traces := testTraces("5 b a", "1 c a")
+	opts := testOptions()
+	opts.EdgeCountMin = 2
+	opts.Format = "graphml"
+	nodes := BuildNodes(traces, opts)
+	a := nodeByName(nodes, "a")
+	if got := a.EdgeWeights[nodeByName(nodes, "b")]; got != 5 {
+		t.Errorf("a -> b: got weight %d; want 5", got)
+	}
+	if _, ok := a.EdgeWeights[nodeByName(nodes, "c")]; ok {
+		t.Error("a -> c, with 1 sample, was kept")
+	}
+	var buf strings.Builder
+	if err := WriteOutput(&buf, testTraces("5 b a", "1 c a"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "<edge "); n != 1 {
+		t.Errorf("graphml output has %d edges; want 1", n)
+	}
+}
+
+func TestFilterMinSelfCum(t *testing.T) {
+	// Cumulative counts: a 20, b 10, c 8, d 10, e 2. Self counts: c 8, d 10, e 2.
+	specs := []string{"8 c b a", "10 d a", "2 e b a"}
+	for _, tt := range []struct {
+		minSelf, minCum float64
+		strict          bool
+		want            string
+	}{
+		{minSelf: 0.42, want: "d"},
+		{minCum: 0.52, want: "a"},
+		{minSelf: 0.42, minCum: 0.45, want: "a b d"},
+		{minSelf: 0.42, minCum: 0.45, strict: true, want: "d"},
+	} {
+		traces := testTraces(specs...)
+		nodes := CreateNodes(traces, 0)
+		// Removing nodes first must not change the total the ratios are of.
+		nodes = FilterNodes(nodes, func(node *Node) bool { return node.Name != "e" })
+		nodes = FilterMinSelfCum(nodes, CountSum(traces), tt.minSelf, tt.minCum, tt.strict)
+		var names []string
+		for _, node := range nodes {
+			names = append(names, node.Name)
+		}
+		sort.Strings(names)
+		if got := strings.Join(names, " "); got != tt.want {
+			t.Errorf("-min-self %g -min-cum %g (strict: %t): got nodes %s; want %s",
+				tt.minSelf, tt.minCum, tt.strict, got, tt.want)
+		}
+	}
+}
+
+func TestStackKey(t *testing.T) {
+	site := func(name, sig, file string, line int) *CallSite {
+		return &CallSite{Name: name, Signature: sig, Filename: file, LineNumber: line}
+	}
+	stack := []*CallSite{site("b", "", "B.java", 3), site("a", "", "A.java", 7)}
+	for _, tt := range []struct {
+		desc        string
+		other       []*CallSite
+		equal       bool // with line numbers
+		equalByName bool // without
+	}{
+		{"identical frames", []*CallSite{site("b", "", "B.java", 3), site("a", "", "A.java", 7)}, true, true},
+		{"another line", []*CallSite{site("b", "", "B.java", 4), site("a", "", "A.java", 7)}, false, true},
+		{"another file", []*CallSite{site("b", "", "C.java", 3), site("a", "", "A.java", 7)}, false, false},
+		{"another signature", []*CallSite{site("b", "(I)V", "B.java", 3), site("a", "", "A.java", 7)}, false, false},
+		{"frames swapped", []*CallSite{site("a", "", "A.java", 7), site("b", "", "B.java", 3)}, false, false},
+		{"a frame missing", []*CallSite{site("b", "", "B.java", 3)}, false, false},
+		{"names run together", []*CallSite{site("b", "", "B.javaa", 3), site("", "", "A.java", 7)}, false, false},
+	} {
+		if got := StackKey(stack, true) == StackKey(tt.other, true); got != tt.equal {
+			t.Errorf("%s, with lines: got equal keys = %t; want %t", tt.desc, got, tt.equal)
+		}
+		if got := StackKey(stack, false) == StackKey(tt.other, false); got != tt.equalByName {
+			t.Errorf("%s, without lines: got equal keys = %t; want %t", tt.desc, got, tt.equalByName)
+		}
+	}
+}
+
+func TestMergeTracesThreads(t *testing.T) {
+	first := testTraces("5 b a", "3 c a")
+	second := testTraces("2 b a", "4 c a")
+	for trace := range first {
+		trace.Thread = 1
+	}
+	for trace := range second {
+		if trace.Stack[0].Name == "c" {
+			trace.Thread = 2
+		} else {
+			trace.Thread = 1
+		}
+	}
+	merged := MergeTraces(first, second)
+	got := make(map[string]int)
+	for trace := range merged {
+		got[fmt.Sprintf("%s in thread %d", trace.Stack[0].Name, trace.Thread)] += trace.Count
+	}
+	want := map[string]int{"b in thread 1": 7, "c in thread 1": 3, "c in thread 2": 4}
+	if !reflect.DeepEqual(got, want) || len(merged) != 3 {
+		t.Errorf("got %d traces with counts %v; want %v", len(merged), got, want)
+	}
+}
+
+func TestMergeTracesIDs(t *testing.T) {
+	first := testTraces("5 b a", "3 c a")
+	second := testTraces("2 d a", "4 b a", "1 e a")
+	merged := MergeTraces(first, second)
+	ids := make(map[string]int)
+	for trace := range merged {
+		ids[trace.Stack[0].Name] = trace.ID
+	}
+	// The b traces are merged into the first one.
+	want := map[string]int{"b": 1, "c": 2, "d": 3, "e": 5}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("got trace IDs %v; want %v", ids, want)
+	}
+	if err := FilterTraceIDs(merged, []int{3}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(stacks(merged), ", "); got != "2 d a" {
+		t.Errorf("-trace-id 3 kept %s; want the d trace of the second set", got)
+	}
+}
+
+func TestCollapseBelow(t *testing.T) {
+	traces := testTraces("50 b a", "30 c a", "1 d b a", "2 e b a", "1 f c a")
+	before := stacks(traces)
+	collapsed, changed := CollapseBelow(traces, 0.05)
+	if changed != 2 {
+		t.Errorf("got %d traces changed; want 2", changed)
+	}
+	if got := stacks(traces); !reflect.DeepEqual(got, before) {
+		t.Errorf("the traces were changed to %v", got)
+	}
+	if got, want := CountSum(collapsed), CountSum(traces); got != want {
+		t.Errorf("got %d samples after collapsing; want %d", got, want)
+	}
+	want := []string{"50 b a", "30 c a", "1 [other]:-1 b a", "2 [other]:-1 b a", "1 f c a"}
+	if got := stacks(collapsed); !reflect.DeepEqual(got, want) {
+		t.Errorf("got collapsed traces %v; want %v", got, want)
+	}
+}
+
+func TestFilterTracesKeepFrames(t *testing.T) {
+	traces := testTraces("4 read util.b app.b util.a app.a", "3 app.c util.a app.a", "2 read util.a")
+	opts := testOptions()
+	opts.KeepFrames = regexp.MustCompile(`^app\.`)
+	FilterTraces(traces, opts)
+	// The intermediate util frames are folded out, the leaves' samples move to the nearest app frame, and
+	// the trace with no app frames is dropped.
+	want := []string{"4 app.b app.a", "3 app.c app.a"}
+	if got := stacks(traces); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got traces %v; want %v", got, want)
+	}
+	nodes := CreateNodes(traces, 0)
+	a, b := nodeByName(nodes, "app.a"), nodeByName(nodes, "app.b")
+	if got := a.EdgeWeights[b]; got != 4 {
+		t.Errorf("app.a -> app.b: got weight %d; want 4", got)
+	}
+	if b.Count != 4 || a.CumulativeCount != 7 {
+		t.Errorf("got app.b self count %d and app.a cumulative count %d; want 4 and 7", b.Count, a.CumulativeCount)
+	}
+}
+
+func TestFilterTracesSignatureGranularity(t *testing.T) {
+	for _, tt := range []struct {
+		granularity string
+		want        []int // self counts of the f nodes
+	}{
+		{"signature", []int{4, 2}},
+		{"function", []int{6}},
+	} {
+		// f is overloaded: lines 10 and 12 are in f(int) and line 20 in f(String).
+		traces := testTraces("3 f:10 main", "1 f:12 main", "2 f:20 main")
+		for trace := range traces {
+			site := trace.Stack[0]
+			site.Signature = "(I)V"
+			if site.LineNumber == 20 {
+				site.Signature = "(Ljava/lang/String;)V"
+			}
+		}
+		opts := testOptions()
+		opts.Granularity = tt.granularity
+		FilterTraces(traces, opts)
+		var counts []int
+		for _, node := range TopLeaves(CreateNodes(traces, 0), 10) {
+			if node.Name == "f" {
+				counts = append(counts, node.Count)
+			}
+		}
+		if !reflect.DeepEqual(counts, tt.want) {
+			t.Errorf("-granularity %s: got f nodes with self counts %v; want %v", tt.granularity, counts, tt.want)
+		}
+	}
+}
+
+func TestCreateNodesRecursion(t *testing.T) {
+	// a calls b calls a calls b: each of a, b, and the edges between them occurs twice in the first trace.
+	traces := testTraces("5 b a b a", "3 b a")
+	nodes := CreateNodes(traces, 0)
+	a, b := nodeByName(nodes, "a"), nodeByName(nodes, "b")
+	for _, tt := range []struct {
+		desc      string
+		got, want int
+	}{
+		{"a cumulative", a.CumulativeCount, 8},
+		{"b cumulative", b.CumulativeCount, 8},
+		{"a self", a.Count, 0},
+		{"b self", b.Count, 8},
+		{"a -> b", a.EdgeWeights[b], 8},
+		{"b -> a", b.EdgeWeights[a], 5},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %d; want %d", tt.desc, tt.got, tt.want)
+		}
+	}
+	if err := CheckCumulativeCounts(nodes, CountSum(traces)); err != nil {
+		t.Error(err)
+	}
+	if err := CheckSelfCounts(nodes, CountSum(traces)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRerootAt(t *testing.T) {
+	traces := testTraces("5 handleA dispatch serve main", "3 handleB dispatch loop main",
+		"2 idle main", "1 handleC dispatch handleA dispatch serve main")
+	RerootAt(traces, regexp.MustCompile("^dispatch$"))
+	// The callers of dispatch are dropped, so the handlers meet under a single root; the root-most dispatch
+	// is the one kept.
+	want := []string{"5 handleA dispatch", "3 handleB dispatch", "1 handleC dispatch handleA dispatch"}
+	if got := stacks(traces); !reflect.DeepEqual(got, want) {
+		t.Errorf("got traces %v; want %v", got, want)
+	}
+	if got := nodeByName(CreateNodes(traces, 0), "dispatch").CumulativeCount; got != 9 {
+		t.Errorf("dispatch: got cumulative count %d; want all 9 samples kept", got)
+	}
+}
+
+func TestCombineSiblings(t *testing.T) {
+	// b calls c from two lines; d calls c from a third.
+	traces := testTraces("3 c:10 b", "2 c:20 b", "4 c:30 d")
+	if merged := CombineSiblings(traces); merged != 1 {
+		t.Errorf("got %d call sites merged; want 1", merged)
+	}
+	nodes := CreateNodes(traces, 0)
+	b, d := nodeByName(nodes, "b"), nodeByName(nodes, "d")
+	if len(b.EdgeWeights) != 1 {
+		t.Fatalf("b has %d children; want 1", len(b.EdgeWeights))
+	}
+	for child, weight := range b.EdgeWeights {
+		if child.Name != "c" || weight != 5 || child.Count != 5 {
+			t.Errorf("got b -> %s with weight %d and self count %d; want c with 5 and 5", child.Name, weight, child.Count)
+		}
+		if _, ok := d.EdgeWeights[child]; ok {
+			t.Error("d's c, which is not b's c's sibling, was merged with it")
+		}
+	}
+}
+
+func TestFoldLeafRecursion(t *testing.T) {
+	traces := testTraces("5 f:3 f:8 f:8 g", "2 f:3 g f:8 g", "1 f")
+	if changed := FoldLeafRecursion(traces); changed != 1 {
+		t.Errorf("got %d traces changed; want 1", changed)
+	}
+	// Only the repetition of the leaf's method directly below it is folded.
+	want := []string{"5 f:3 g", "2 f:3 g f:8 g", "1 f"}
+	if got := stacks(traces); !reflect.DeepEqual(got, want) {
+		t.Errorf("got traces %v; want %v", got, want)
+	}
+}
+
+// dotStatement matches the lines of a DOT graph written by DotGraph.Write, other than its first and last.
+var dotStatement = regexp.MustCompile(`^(|node \[.*\];|\w+ \[.*\];|N\d+ -> N\d+ \[.*\];)$`)
+
+func TestRenderStdoutGraphStats(t *testing.T) {
+	opts := testOptions()
+	opts.Format = "dot"
+	opts.Quiet = false
+	opts.GraphStats = true
+	var err error
+	stdout, stderr := captureOutput(t, func() {
+		err = render(filepath.Join("testdata", "sample.txt"), "-", opts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+	if !strings.HasPrefix(lines[0], "digraph ") || lines[len(lines)-1] != "}" {
+		t.Fatalf("the output is not a DOT graph:\n%s", stdout)
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		if !dotStatement.MatchString(line) {
+			t.Errorf("the DOT output has a stray line %q", line)
+		}
+	}
+	if !strings.Contains(stderr, "Graph: 8 nodes, 8 edges") {
+		t.Errorf("the graph statistics are missing from stderr:\n%s", stderr)
+	}
+}
+
+func TestRenderOptions(t *testing.T) {
+	// render takes everything from its arguments, not the flags.
+	opts := testOptions()
+	opts.Format = "folded"
+	opts.TraceIDs = []int{300002, 300004}
+	opts.Parse.Strict = true
+	output := filepath.Join(t.TempDir(), "out.folded")
+	if err := render(filepath.Join("testdata", "sample.txt"), output, opts); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "com.example.Main.main;com.example.Baz.go;java.util.HashMap.get 10\n" +
+		"com.example.Main.main;com.example.Foo.run;com.example.Bar.compute 50\n"
+	if got := string(b); got != want {
+		t.Errorf("got output\n%s\nwant\n%s", got, want)
+	}
+
+	opts.TraceIDs = []int{1}
+	if err := render(filepath.Join("testdata", "sample.txt"), output, opts); err == nil {
+		t.Error("rendering with -trace-id 1, which sample.txt lacks, succeeded")
+	}
+}
+
+func TestRenderStdinLeftOpen(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "sample.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+	os.Stdin = f
+	opts := testOptions()
+	opts.Format = "csv"
+	if err := render("-", filepath.Join(t.TempDir(), "out.csv"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Stat(); err != nil {
+		t.Errorf("stdin was closed by render: %s", err)
+	}
+}
+
+func TestRenderListTraces(t *testing.T) {
+	opts := testOptions()
+	opts.Quiet = false
+	opts.TopK = 2
+	opts.ListTraces = true
+	var err error
+	stdout, stderr := captureOutput(t, func() {
+		err = render(filepath.Join("testdata", "sample.txt"), "", opts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "TRACE 300002: 50 samples\n" +
+		"  com.example.Bar.compute[Bar.java:20]\n  com.example.Foo.run[Foo.java:11]\n  com.example.Main.main[Main.java:5]\n" +
+		"TRACE 300003: 25 samples\n" +
+		"  com.example.Bar.compute[Bar.java:20]\n  com.example.Baz.go[Baz.java:3]\n  com.example.Main.main[Main.java:5]\n"
+	if stdout != want {
+		t.Errorf("got listing\n%s\nwant\n%s", stdout, want)
+	}
+	if !strings.Contains(stderr, "Keeping 75/100") {
+		t.Errorf("the info lines are missing from stderr:\n%s", stderr)
+	}
+}
+
+func TestRenderListFrames(t *testing.T) {
+	opts := testOptions()
+	opts.Quiet = false
+	opts.TopK = 1
+	opts.ListFrames = true
+	var err error
+	stdout, stderr := captureOutput(t, func() {
+		err = render(filepath.Join("testdata", "sample.txt"), "", opts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "com.example.Bar.compute\tBar.java\t20\n" +
+		"com.example.Foo.run\tFoo.java\t11\n" +
+		"com.example.Main.main\tMain.java\t5\n"
+	if stdout != want {
+		t.Errorf("got listing\n%s\nwant\n%s", stdout, want)
+	}
+	if !strings.Contains(stderr, "Keeping 50/100") {
+		t.Errorf("the info lines are missing from stderr:\n%s", stderr)
+	}
+}
+
+func TestRenderSummary(t *testing.T) {
+	opts := testOptions()
+	opts.Quiet = false
+	opts.TopK = 1
+	opts.Summary = true
+	var err error
+	stdout, stderr := captureOutput(t, func() {
+		err = render(filepath.Join("testdata", "sample.txt"), "", opts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stdout, "50 samples in 1 traces; max stack depth 3\n") || strings.Contains(stdout, "Keeping") {
+		t.Errorf("got summary\n%s\nwant only the summary of trace 300002", stdout)
+	}
+	if !strings.Contains(stderr, "Keeping 50/100") {
+		t.Errorf("the info lines are missing from stderr:\n%s", stderr)
+	}
+}
+
+func TestParseTar(t *testing.T) {
+	sample, err := os.ReadFile(filepath.Join("testdata", "sample.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(sample); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, member := range []struct {
+		name string
+		body []byte
+	}{
+		{"run1/prof.txt", sample},
+		{"run1/notes.txt", []byte("not a profile")},
+		{"run2/prof.txt.gz", gz.Bytes()},
+	} {
+		hdr := &tar.Header{Name: member.name, Mode: 0644, Size: int64(len(member.body)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(member.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions()
+	opts.Filename = "runs.tar"
+	opts.TarGlob = "prof*"
+	traces, err := parseTar(bytes.NewReader(archive.Bytes()), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both profiles are merged, doubling the sample's counts.
+	if got := traceCounts(traces); !reflect.DeepEqual(got, map[int]int{300001: 30, 300002: 100, 300003: 50, 300004: 20}) {
+		t.Errorf("got trace counts %v", got)
+	}
+
+	opts.MergeThreshold = 40
+	traces, err = parseTar(bytes.NewReader(archive.Bytes()), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := traceCounts(traces); !reflect.DeepEqual(got, map[int]int{300002: 100, 300003: 50}) {
+		t.Errorf("with -merge-threshold 40, got trace counts %v; want the traces with fewer samples dropped", got)
+	}
+
+	opts.TarGlob = "*.csv"
+	_, err = parseTar(bytes.NewReader(archive.Bytes()), opts)
+	if want := `No members of runs.tar match "*.csv".`; err == nil || err.Error() != want {
+		t.Errorf("got error %v; want %q", err, want)
+	}
+}
+
+func TestMergeUnknown(t *testing.T) {
+	for _, tt := range []struct {
+		perMethod bool
+		want      []string
+	}{
+		// Consecutive frames are folded once they share the one [unknown] call site.
+		{false, []string{"4 a [unknown]:-1 d", "2 [unknown]:-1 d", "1 [unknown]:-1 d"}},
+		// Each method keeps its own call site, so only the a frames are unchanged.
+		{true, []string{"4 a b:-1 c:-1 d", "2 b:-1 c:-1 b:-1 d", "1 a:-1 d"}},
+	} {
+		traces := testTraces("4 a b:0 c:0 d", "2 b:0 c:0 b:5 d", "1 a:0 d")
+		for trace := range traces {
+			for _, site := range trace.Stack {
+				if site.LineNumber == 5 {
+					// A frame with a line but no file is also unknown.
+					site.Filename = "Native Method"
+				}
+			}
+		}
+		if frames := MergeUnknown(traces, tt.perMethod); frames != 6 {
+			t.Errorf("perMethod=%t: got %d frames merged; want 6", tt.perMethod, frames)
+		}
+		if got := stacks(traces); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("perMethod=%t: got traces %v; want %v", tt.perMethod, got, tt.want)
+		}
+	}
+}
+
+func TestPartitionByThread(t *testing.T) {
+	traces := testTraces("5 b a", "3 c a", "3 d a", "4 b a", "1 c a", "1 d a")
+	// Threads 1 and 2 both have 6 samples, so they are ordered by serial.
+	for trace := range traces {
+		trace.Thread = map[int]int{1: 2, 2: 1, 3: 1, 4: 3, 5: 2, 6: 4}[trace.ID]
+	}
+	for _, tt := range []struct {
+		topN int
+		want []string
+	}{
+		{0, []string{"thread-1 [1] 6", "thread-2 [2] 6", "thread-3 [3] 4", "thread-4 [4] 1"}},
+		{4, []string{"thread-1 [1] 6", "thread-2 [2] 6", "thread-3 [3] 4", "thread-4 [4] 1"}},
+		{2, []string{"thread-1 [1] 6", "thread-2 [2] 6", "other-threads [3 4] 5"}},
+		{1, []string{"thread-1 [1] 6", "other-threads [2 3 4] 11"}},
+	} {
+		var got []string
+		for _, g := range PartitionByThread(traces, tt.topN) {
+			got = append(got, fmt.Sprintf("%s %v %d", g.Name, g.Threads, CountSum(g.Traces)))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("topN=%d: got groups %q; want %q", tt.topN, got, tt.want)
+		}
+	}
+}
+
+func TestHashNames(t *testing.T) {
+	for _, hashLines := range []bool{false, true} {
+		traces := testTraces("3 c b:4 a", "2 c:7 b:4", "1 c:0 [root]")
+		for trace := range traces {
+			for _, site := range trace.Stack {
+				switch site.Name {
+				case "c":
+					site.Signature = "(I)V"
+				case "[root]":
+					site.Synthetic = true
+				}
+				if site.LineNumber == 0 {
+					site.Filename = "Unknown Source"
+				}
+			}
+		}
+		HashNames(traces, hashLines)
+		got := strings.Join(stacks(traces), ", ")
+		// The hash of "a" is the start of sha256("a"), ca978112, and so on. The call sites of c share a hashed
+		// name and keep their own lines; unknown lines stay unknown.
+		want := "3 2e7d2c03:60354 3e23e816:33307 ca978112:26625, 2 2e7d2c03:39348 3e23e816:33307, 1 2e7d2c03:0 [root]"
+		if !hashLines {
+			want = "3 2e7d2c03 3e23e816:4 ca978112, 2 2e7d2c03:7 3e23e816:4, 1 2e7d2c03:0 [root]"
+		}
+		if got != want {
+			t.Errorf("hashLines=%t: got traces %s; want %s", hashLines, got, want)
+		}
+		for trace := range traces {
+			for _, site := range trace.Stack {
+				switch {
+				case site.Synthetic:
+				case site.LineNumber == 0 && site.Filename != "Unknown Source":
+					t.Errorf("the unknown filename of %s was hashed to %s", site.Name, site.Filename)
+				case site.LineNumber != 0 && (len(site.Filename) != 8 || strings.Contains(site.Filename, ".java")):
+					t.Errorf("the filename of %s was not hashed: %s", site.Name, site.Filename)
+				}
+				if site.Name == "2e7d2c03" && site.Signature != "(d00df772)" {
+					t.Errorf("got signature %s for c; want (d00df772)", site.Signature)
+				}
+			}
+		}
+	}
+}
+
+func TestOpenChunks(t *testing.T) {
+	sample, err := os.ReadFile(filepath.Join("testdata", "sample.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// The chunks are written out of order; the middle one is gzipped.
+	third := len(sample) / 3
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(sample[third : 2*third]); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range []struct {
+		name string
+		body []byte
+	}{
+		{"profile.003", sample[2*third:]},
+		{"profile.001", sample[:third]},
+		{"profile.002", gz.Bytes()},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, chunk.name), chunk.body, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := openChunks(filepath.Join(dir, "profile.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, sample) {
+		t.Errorf("the chunks read back as\n%s\nwant\n%s", got, sample)
+	}
+
+	pattern := filepath.Join(dir, "other.*")
+	_, err = openChunks(pattern)
+	if want := fmt.Sprintf("No files match -chunks %q.", pattern); err == nil || err.Error() != want {
+		t.Errorf("got error %v; want %q", err, want)
+	}
+}
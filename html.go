@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// htmlTableRows is the number of rows in each table of the HTML report.
+const htmlTableRows = 20
+
+type htmlStack struct {
+	Count   int
+	Percent float64
+	Frames  []string // leaf first
+}
+
+type htmlLeaf struct {
+	Self, Cumulative               int
+	SelfPercent, CumulativePercent float64
+	CallSite                       string
+}
+
+type htmlReport struct {
+	Filename string
+	Total    int
+	SVG      template.HTML
+	Stacks   []htmlStack
+	Leaves   []htmlLeaf
+}
+
+// WriteHTMLReport writes a self-contained HTML page to w showing the graph of nodes as an inline SVG image,
+// followed by tables of the most frequently sampled stacks in traces and the call sites with the most self
+// samples. Rendering the SVG requires Graphviz's dot command.
+func WriteHTMLReport(w io.Writer, traces map[*Trace]bool, nodes []*Node, opts Options) error {
+	dot, err := RenderDot(nodes, opts)
+	if err != nil {
+		return err
+	}
+	svg, err := renderSVG(dot, opts.RenderTimeout)
+	if err != nil {
+		return err
+	}
+	report := htmlReport{
+		Filename: opts.Filename,
+		Total:    CountSum(traces),
+		SVG:      template.HTML(svg),
+	}
+	percent := func(n int) float64 {
+		if report.Total == 0 {
+			return 0
+		}
+		return 100 * float64(n) / float64(report.Total)
+	}
+
+	for _, trace := range SortedTraces(traces) {
+		if len(report.Stacks) == htmlTableRows {
+			break
+		}
+		stack := htmlStack{Count: trace.Count, Percent: percent(trace.Count)}
+		for _, site := range trace.Stack {
+			stack.Frames = append(stack.Frames, site.String())
+		}
+		report.Stacks = append(report.Stacks, stack)
+	}
+
+	for _, node := range TopLeaves(nodes, htmlTableRows) {
+		if node.Count == 0 && !opts.IncludeEmptyCounts {
+			break
+		}
+		report.Leaves = append(report.Leaves, htmlLeaf{
+			Self:              node.Count,
+			Cumulative:        node.CumulativeCount,
+			SelfPercent:       percent(node.Count),
+			CumulativePercent: percent(node.CumulativeCount),
+			CallSite:          node.CallSite.String(),
+		})
+	}
+	return htmlTemplate.Execute(w, report)
+}
+
+// renderSVG runs Graphviz's dot to lay out the DOT graph as SVG. The XML prolog is removed so that the SVG
+// can be embedded in HTML. If timeout is positive, dot is killed if it runs longer than that.
+func renderSVG(dot string, timeout time.Duration) (string, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "dot", "-Tsvg")
+	cmd.Stdin = strings.NewReader(dot)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("running dot (from Graphviz) took longer than -render-timeout %s", timeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("running dot (from Graphviz) failed: %s: %s", err, msg)
+		}
+		return "", fmt.Errorf("running dot (from Graphviz) failed: %s", err)
+	}
+	svg := stdout.String()
+	if i := strings.Index(svg, "<svg"); i >= 0 {
+		svg = svg[i:]
+	}
+	return svg, nil
+}
+
+var htmlTemplate = template.Must(template.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>HProf report for {{.Filename}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.graph { overflow: auto; border: 1px solid #ccc; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; vertical-align: top; }
+td.num { text-align: right; }
+td.stack { font-family: monospace; white-space: pre; }
+</style>
+</head>
+<body>
+<h1>HProf report for {{.Filename}}</h1>
+<p>{{.Total}} samples.</p>
+<div class="graph">
+{{.SVG}}
+</div>
+<h2>Top stacks</h2>
+<table>
+<tr><th>Samples</th><th>%</th><th>Stack (innermost frame first)</th></tr>
+{{range .Stacks}}<tr><td class="num">{{.Count}}</td><td class="num">{{printf "%.1f" .Percent}}</td><td class="stack">{{range .Frames}}{{.}}
+{{end}}</td></tr>
+{{end}}</table>
+<h2>Top call sites by self samples</h2>
+<table>
+<tr><th>Self</th><th>%</th><th>Cumulative</th><th>%</th><th>Call site</th></tr>
+{{range .Leaves}}<tr><td class="num">{{.Self}}</td><td class="num">{{printf "%.1f" .SelfPercent}}</td><td class="num">{{.Cumulative}}</td><td class="num">{{printf "%.1f" .CumulativePercent}}</td><td>{{.CallSite}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeDot is a stand-in for Graphviz's dot that ignores its input and writes a fixed SVG image.
+const fakeDot = `#!/bin/sh
+cat >/dev/null
+echo '<?xml version="1.0" encoding="UTF-8" standalone="no"?>'
+echo '<svg id="fake"></svg>'
+`
+
+func TestWriteHTMLReport(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake dot command is a shell script")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "dot"), []byte(fakeDot), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	traces := sampleTraces(t)
+	opts := testOptions()
+	opts.Format = "html"
+	opts.Filename = "sample.txt"
+	var buf strings.Builder
+	if err := WriteOutput(&buf, traces, opts); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	if !strings.HasPrefix(got, "<!DOCTYPE html>") || !strings.HasSuffix(got, "</html>\n") {
+		t.Errorf("the output is not a whole HTML page:\n%s", got)
+	}
+	if !strings.Contains(got, `<div class="graph">`+"\n"+`<svg id="fake"></svg>`) || strings.Contains(got, "<?xml") {
+		t.Errorf("the output doesn't embed the SVG image without its XML prolog:\n%s", got)
+	}
+	// A header and 4 stacks, then a header and the 3 call sites with self samples.
+	if n := strings.Count(got, "<tr>"); n != 9 {
+		t.Errorf("got %d table rows; want 9", n)
+	}
+	if n := strings.Count(got, "</tr>"); n != 9 {
+		t.Errorf("got %d closed table rows; want 9", n)
+	}
+	// Bar.compute appears in two stacks and as one call site.
+	const escaped = `com.example.Map&lt;K,V&gt;.&#34;get&#34;&amp;set`
+	if n := strings.Count(got, escaped); n != 3 {
+		t.Errorf("got %d escaped occurrences of %q; want 3", n, trickyName)
+	}
+	if strings.Contains(got, "<K,V>") {
+		t.Error("the output has an unescaped method name")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/cespare/hprofviz/internal/infile"
+)
+
+// A chunkReader reads the concatenated content of several chunk files.
+type chunkReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (r *chunkReader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// openChunks opens the files matching the glob pattern, in sorted order, as one stream, for a profile that was
+// split into numbered chunks (such as profile.001, profile.002, ...). Chunks may be individually gzipped.
+func openChunks(pattern string) (io.ReadCloser, error) {
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Bad -chunks pattern %q: %s", pattern, err)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No files match -chunks %q.", pattern)
+	}
+	sort.Strings(names)
+	r := new(chunkReader)
+	var readers []io.Reader
+	for _, name := range names {
+		f, err := infile.Open(name)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.files = append(r.files, f)
+		cr, err := infile.MaybeGunzip(f)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("Cannot read chunk %s: %s", name, err)
+		}
+		readers = append(readers, cr)
+	}
+	r.Reader = io.MultiReader(readers...)
+	return r, nil
+}
+
+// ParseTar parses each regular file in the (optionally gzip-compressed) tar archive read from r whose base
+// name matches the glob pattern. Members that are themselves gzip-compressed are decompressed. The traces from
+// all the members are merged. ParseTar also returns the names of the members it parsed.
+func ParseTar(r io.Reader, pattern string, popts ParseOptions) (map[*Trace]bool, []string, error) {
+	r, err := infile.MaybeGunzip(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(r)
+	var sets []map[*Trace]bool
+	var members []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		ok, err := path.Match(pattern, path.Base(hdr.Name))
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+		mr, err := infile.MaybeGunzip(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", hdr.Name, err)
+		}
+		traces, err := ParseHProf(mr, popts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", hdr.Name, err)
+		}
+		sets = append(sets, traces)
+		members = append(members, hdr.Name)
+	}
+	return MergeTraces(sets...), members, nil
+}
+
+// MergeTraces combines several sets of traces, such as those parsed from different files, into one. Equal
+// call sites from different sets are merged so that they become a single node in the graph, and traces with
+// equal stacks sampled in the same thread (see TraceKey) are merged into one, summing their counts.
+//
+// Each set numbers its traces from the start, so MergeTraces renumbers them to keep trace IDs (and file
+// order) unique: the traces of the first set keep their IDs, and the IDs of each later set are offset by the
+// largest ID of the sets before it.
+func MergeTraces(sets ...map[*Trace]bool) map[*Trace]bool {
+	merged := make(map[*Trace]bool)
+	idBase, seqBase := 0, 0
+	for _, traces := range sets {
+		maxID, maxSeq := idBase, seqBase-1
+		for trace := range traces {
+			if len(sets) > 1 {
+				trace.ID += idBase
+				trace.Seq += seqBase
+			}
+			if trace.ID > maxID {
+				maxID = trace.ID
+			}
+			if trace.Seq > maxSeq {
+				maxSeq = trace.Seq
+			}
+			merged[trace] = true
+		}
+		idBase, seqBase = maxID, maxSeq+1
+	}
+	if len(sets) > 1 {
+		MergeCallSites(merged, func(site *CallSite) string {
+			return fmt.Sprintf("%s\x00%s\x00%s\x00%d", site.Name, site.Signature, site.Filename, site.LineNumber)
+		})
+		byStack := make(map[string]*Trace)
+		for _, trace := range SortedTraces(merged) {
+			key := TraceKey(trace, true)
+			if first, ok := byStack[key]; ok {
+				first.Count += trace.Count
+				delete(merged, trace)
+				continue
+			}
+			byStack[key] = trace
+		}
+	}
+	return merged
+}
+
+// DropRareTraces deletes the traces with fewer than min samples and returns how many it deleted.
+func DropRareTraces(traces map[*Trace]bool, min int) int {
+	dropped := 0
+	for trace := range traces {
+		if trace.Count < min {
+			delete(traces, trace)
+			dropped++
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,87 @@
+// Package infile opens the input files of the hprofviz commands.
+package infile
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Open opens the named input file, or, for a name like "fd:3", the inherited file descriptor 3, or, for "-",
+// standard input. Its errors say what went wrong in terms a user can act on, and wrap the underlying error (so
+// that, for example, errors.Is(err, fs.ErrNotExist) reports a missing file).
+func Open(name string) (*os.File, error) {
+	if name == "-" {
+		return os.Stdin, nil
+	}
+	if strings.HasPrefix(name, "fd:") {
+		return openFD(name)
+	}
+	f, err := os.Open(name)
+	switch {
+	case os.IsNotExist(err):
+		return nil, fmt.Errorf("cannot open %s: %w", name, fs.ErrNotExist)
+	case os.IsPermission(err):
+		return nil, fmt.Errorf("cannot open %s: %w (check the file's permissions)", name, fs.ErrPermission)
+	case err != nil:
+		return nil, fmt.Errorf("cannot open %s: %w", name, err)
+	}
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("cannot read %s: it is a directory (give the path of a file inside it)", name)
+	}
+	return f, nil
+}
+
+// openFD returns the file descriptor given by an input name of the form "fd:N".
+func openFD(name string) (*os.File, error) {
+	fd, err := strconv.ParseUint(strings.TrimPrefix(name, "fd:"), 10, 31)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: a file descriptor must be given as fd:N (such as fd:3)", name)
+	}
+	// Close f on failure, rather than leaving it to its finalizer, which could close the descriptor number
+	// after it is reused.
+	f := os.NewFile(uintptr(fd), name)
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot read %s: file descriptor %d is not open (was it passed to the command?): %w",
+			name, fd, err)
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("cannot read %s: it is a directory", name)
+	}
+	return f, nil
+}
+
+// MaybeGunzip returns a reader of the decompressed content of r if r starts with the gzip magic number, and a
+// reader of r's content as-is otherwise.
+func MaybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// A CountingReader counts the bytes read through it from R in N.
+type CountingReader struct {
+	R io.Reader
+	N int64
+}
+
+func (r *CountingReader) Read(b []byte) (int, error) {
+	n, err := r.R.Read(b)
+	r.N += int64(n)
+	return n, err
+}
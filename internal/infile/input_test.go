@@ -0,0 +1,64 @@
+package infile
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenNotExist(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "missing.txt")
+	_, err := Open(name)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Open(%q): got error %v; want one wrapping fs.ErrNotExist", name, err)
+	}
+	if !strings.Contains(err.Error(), name) {
+		t.Errorf("error %q doesn't name the file", err)
+	}
+}
+
+func TestOpenDirectory(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Open(dir)
+	if err == nil || !strings.Contains(err.Error(), "is a directory") {
+		t.Fatalf("Open(%q): got error %v; want a directory error", dir, err)
+	}
+}
+
+func TestOpenStdin(t *testing.T) {
+	f, err := Open("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != os.Stdin {
+		t.Errorf(`Open("-") didn't return os.Stdin`)
+	}
+}
+
+func TestOpenBadFD(t *testing.T) {
+	for _, name := range []string{"fd:x", "fd:-1", "fd:1000"} {
+		if _, err := Open(name); err == nil {
+			t.Errorf("Open(%q): got no error", name)
+		}
+	}
+}
+
+func TestOpenFDDirectory(t *testing.T) {
+	d, err := os.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	name := fmt.Sprintf("fd:%d", d.Fd())
+	if _, err := Open(name); err == nil || !strings.Contains(err.Error(), "is a directory") {
+		t.Fatalf("Open(%q): got error %v; want a directory error", name, err)
+	}
+	// The descriptor was given to Open, which closes it on failure.
+	if _, err := d.Stat(); err == nil {
+		t.Errorf("Open(%q) left the descriptor open", name)
+	}
+}
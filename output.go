@@ -0,0 +1,88 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// An outputFile is the destination of the rendered output. It is written to a temporary file in the same
+// directory which is renamed into place by Commit, so that readers never see a partial file. If the output is
+// gzipped, the compressed stream is also finished by Commit, before the rename. An output named "-" is written
+// to standard output directly.
+type outputFile struct {
+	*os.File
+	name string       // final name
+	gz   *gzip.Writer // if non-nil, writes are compressed through gz
+}
+
+// createOutput creates the output file name. If compress is set, the output is gzipped.
+func createOutput(name string, compress bool) (*outputFile, error) {
+	if name == "-" {
+		out := &outputFile{File: os.Stdout, name: name}
+		if compress {
+			out.gz = gzip.NewWriter(os.Stdout)
+		}
+		return out, nil
+	}
+	f, err := createTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	out := &outputFile{File: f, name: name}
+	if compress {
+		out.gz = gzip.NewWriter(f)
+	}
+	return out, nil
+}
+
+// createTemp creates a new file in dir whose name starts with prefix, like ioutil.TempFile, but with the
+// permissions that os.Create gives a file (0666, less the umask) rather than 0600, since it becomes the output.
+func createTemp(dir, prefix string) (*os.File, error) {
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// Writer returns the writer to render the output to.
+func (f *outputFile) Writer() io.Writer {
+	if f.gz != nil {
+		return f.gz
+	}
+	return f.File
+}
+
+// Commit finishes writing and moves the output into place.
+func (f *outputFile) Commit() error {
+	if f.gz != nil {
+		if err := f.gz.Close(); err != nil {
+			f.Abort()
+			return err
+		}
+	}
+	if f.name == "-" {
+		return nil
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), f.name)
+}
+
+// Abort discards the output.
+func (f *outputFile) Abort() {
+	if f.name == "-" {
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
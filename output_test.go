@@ -0,0 +1,47 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCreateOutputMode(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(0))
+	for _, umask := range []int{0, 022, 077} {
+		syscall.Umask(umask)
+		name := filepath.Join(t.TempDir(), "out.dot")
+		out, err := createOutput(name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(out.Writer(), "digraph {}\n")
+		if err := out.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fi.Mode().Perm(), os.FileMode(0666&^umask); got != want {
+			t.Errorf("with umask %#o: got mode %v; want %v", umask, got, want)
+		}
+	}
+}
+
+func TestCreateOutputAbort(t *testing.T) {
+	dir := t.TempDir()
+	out, err := createOutput(filepath.Join(dir, "out.dot"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(out.Writer(), "digraph {}\n")
+	out.Abort()
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) > 0 {
+		t.Errorf("Abort left files behind: %v", names)
+	}
+}
@@ -3,38 +3,117 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/cespare/hprofviz/internal/infile"
 )
 
 var (
-	traceLine      = regexp.MustCompile(`^([^\(]+)\(([^\:]+):([^\)]+)\)$`)
-	traceHeader    = regexp.MustCompile(`^TRACE (\d+):$`)
-	samplesHeader  = regexp.MustCompile(`^CPU SAMPLES BEGIN \(total = (\d+)\)`)
-	samplesColumns = regexp.MustCompile(`^rank\s+self\s+accum\s+count\s+trace\s+method$`)
+	// Some hprof variants include the argument list (the signature) after the method name.
+	traceLine = regexp.MustCompile(`^([^\(]+)(\([^\)]*\)[^\(]*)?\(([^\:]+):([^\)]+)\)$`)
+	// With thread=y, hprof notes the thread serial after the trace ID.
+	traceHeader   = regexp.MustCompile(`^TRACE (\d+):(?:\s*\(thread=(\d+)\))?$`)
+	fileHeader    = regexp.MustCompile(`^JAVA PROFILE [\d.]+, created (.*)$`)
+	threadStart   = regexp.MustCompile(`^THREAD START \(obj=\w+, id = (\d+), name="(.*)", group="(.*)"\)$`)
+	threadEnd     = regexp.MustCompile(`^THREAD END \(id = (\d+)\)$`)
+	samplesHeader = regexp.MustCompile(`^CPU SAMPLES BEGIN \(total = (\d+)\)\s*(.*)$`)
+	// Some hprof variants note the sampling interval after the total.
+	samplesInterval = regexp.MustCompile(`\binterval\s*=\s*(\d+)\s*ms\b`)
+	// Some preprocessing tools run-length encode repeated frames as, e.g., "a.B.c(B.java:10) x3".
+	repeatedFrame = regexp.MustCompile(`^(.*\))\s+x(\d+)$`)
 )
 
-func ParseHProfFile(filename string) map[*Trace]bool {
-	f, err := os.Open(filename)
+// ParseOptions controls the parsing of nonstandard dumps.
+type ParseOptions struct {
+	ExpandRepeats bool // expand frames with a repeat suffix, such as "x3", into that many frames
+	Strict        bool // fail, rather than warn, on samples of traces that the dump doesn't define
+}
+
+// A ParseError is a problem with a line of a dump.
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Line %d: %s", e.Line, e.Msg)
+}
+
+// ParseHProfFile parses the text output of hprof's CPU sampling from the named file (or, for "-", from
+// standard input), which may be gzip-compressed. It is a thin wrapper around ParseHProf.
+func ParseHProfFile(filename string) (map[*Trace]bool, error) {
+	f, err := infile.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := infile.MaybeGunzip(f)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read %s: %s", filename, err)
+	}
+	return ParseHProf(r, ParseOptions{})
+}
+
+// ParseHProf parses the text output of hprof's CPU sampling from r.
+func ParseHProf(r io.Reader, popts ParseOptions) (map[*Trace]bool, error) {
+	profile, err := ParseProfile(r, popts)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return profile.Traces, nil
+}
+
+// A Thread is a thread listed in a THREAD START record.
+type Thread struct {
+	Serial int // as in Trace.Thread
+	Name   string
+	Group  string
+	Ended  bool // whether there is a THREAD END record for the thread
+}
+
+// A Profile is the parsed content of an hprof CPU sampling dump.
+type Profile struct {
+	Traces    map[*Trace]bool
+	Threads   map[int]*Thread // by serial
+	Total     int             // sample count given in the CPU SAMPLES header
+	Created   time.Time       // time profiling started, if given in the file header
+	Timestamp time.Time       // time the samples were dumped, if given in the CPU SAMPLES header
+	Interval  time.Duration   // sampling interval, if given in the CPU SAMPLES header
+}
 
+// ParseProfile parses the text output of hprof's CPU sampling from r, including the information in the
+// CPU SAMPLES header. Problems with the content are reported as a *ParseError.
+func ParseProfile(r io.Reader, popts ParseOptions) (*Profile, error) {
+	profile := &Profile{Threads: make(map[int]*Thread)}
 	lineNumber := 0
-	parseError := func(args ...interface{}) {
-		argList := append([]interface{}{fmt.Sprintf("Line %d: ", lineNumber)}, args...)
-		log.Fatalln(argList...)
+	parseError := func(args ...interface{}) error {
+		return &ParseError{Line: lineNumber, Msg: strings.TrimSuffix(fmt.Sprintln(args...), "\n")}
 	}
-	parseErrorf := func(format string, args ...interface{}) {
-		log.Fatalf(fmt.Sprintf("Line %d: ", lineNumber)+format, args...)
+	parseErrorf := func(format string, args ...interface{}) error {
+		return &ParseError{Line: lineNumber, Msg: fmt.Sprintf(format, args...)}
 	}
 	traces := make(map[int]*Trace)          // by ID
 	callSites := make(map[string]*CallSite) // by line (stripped of leading \t)
 	var currentTrace *Trace
-	scanner := bufio.NewScanner(f)
+	// A sampleRow is a row of the CPU SAMPLES table. Rows are normally preceded by the definitions of their
+	// traces, but in case they aren't, rows for unknown traces are resolved after the whole file is read.
+	type sampleRow struct {
+		lineNumber, id, count, rank int
+		self, accum                 float64
+	}
+	setSamples := func(trace *Trace, row sampleRow) {
+		trace.Count = row.count
+		trace.Rank = row.rank
+		trace.SelfPercent = row.self
+		trace.AccumPercent = row.accum
+	}
+	var unresolved []sampleRow
+	scanner := bufio.NewScanner(r)
 	// Sometimes lines are longer than the 64k Scanner default.
 	// Start out with a 500k buffer and allow up to 10MB.
 	scanner.Buffer(make([]byte, 500e3), 10e6)
@@ -43,6 +122,10 @@ func ParseHProfFile(filename string) map[*Trace]bool {
 	for scanner.Scan() {
 		lineNumber++
 		line := scanner.Text()
+		if lineNumber == 1 {
+			// Files saved by some editors start with a byte order mark.
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
 
 		if inTrace && !strings.HasPrefix(line, "\t") {
 			inTrace = false
@@ -55,85 +138,183 @@ func ParseHProfFile(filename string) map[*Trace]bool {
 				inTrace = true
 				id, err := strconv.Atoi(traceHeaderParts[1])
 				if err != nil {
-					parseError("cannot parse TRACE line")
+					return nil, parseError("cannot parse TRACE line")
+				}
+				currentTrace = &Trace{ID: id, Seq: len(traces)}
+				if traceHeaderParts[2] != "" {
+					thread, err := strconv.Atoi(traceHeaderParts[2])
+					if err != nil {
+						return nil, parseError("cannot parse thread in TRACE line")
+					}
+					currentTrace.Thread = thread
 				}
-				currentTrace = &Trace{ID: id}
 				if _, ok := traces[id]; ok {
-					parseError("duplicate trace with id", id)
+					return nil, parseError("duplicate trace with id", id)
 				}
 				traces[id] = currentTrace
 				continue
 			}
-			if samplesHeader.MatchString(line) {
+			if m := threadStart.FindStringSubmatch(line); m != nil {
+				serial, err := strconv.Atoi(m[1])
+				if err != nil {
+					return nil, parseError("cannot parse thread id in THREAD START line")
+				}
+				profile.Threads[serial] = &Thread{Serial: serial, Name: m[2], Group: m[3]}
+				continue
+			}
+			if m := threadEnd.FindStringSubmatch(line); m != nil {
+				serial, err := strconv.Atoi(m[1])
+				if err != nil {
+					return nil, parseError("cannot parse thread id in THREAD END line")
+				}
+				if t, ok := profile.Threads[serial]; ok {
+					t.Ended = true
+				}
+				continue
+			}
+			if m := fileHeader.FindStringSubmatch(line); m != nil {
+				if t, err := time.Parse(time.ANSIC, m[1]); err == nil {
+					profile.Created = t
+				}
+				continue
+			}
+			if samplesHeaderParts := samplesHeader.FindStringSubmatch(line); samplesHeaderParts != nil {
 				inSamples = true
+				total, err := strconv.Atoi(samplesHeaderParts[1])
+				if err != nil {
+					return nil, parseError("cannot parse sample total")
+				}
+				profile.Total = total
+				parseSamplesHeaderExtra(profile, samplesHeaderParts[2])
 			}
 			continue
 		}
 
 		if inTrace {
 			line = strings.TrimPrefix(line, "\t") // We already know the line has a \t prefix
+			repeats := 1
+			if popts.ExpandRepeats {
+				if m := repeatedFrame.FindStringSubmatch(line); m != nil {
+					n, err := strconv.Atoi(m[2])
+					if err != nil || n < 1 {
+						return nil, parseError("bad frame repeat count")
+					}
+					line, repeats = m[1], n
+				}
+			}
 			callSite, ok := callSites[line]
 			if !ok {
 				traceLineParts := traceLine.FindStringSubmatch(line)
-				if len(traceLineParts) != 4 {
-					parseError("cannot parse trace line")
+				if len(traceLineParts) != 5 {
+					return nil, parseError("cannot parse trace line")
 				}
 				var n int
-				n, err := strconv.Atoi(traceLineParts[3])
+				n, err := strconv.Atoi(traceLineParts[4])
 				if err != nil {
-					if traceLineParts[3] == "Unknown line" {
+					switch traceLineParts[4] {
+					case "Unknown line":
 						n = -1
-					} else {
-						parseError("bad line number")
+					case "Native method":
+						n = NativeMethodLine
+					case "Compiled method":
+						n = CompiledMethodLine
+					default:
+						return nil, parseError("bad line number")
 					}
 				}
 				callSite = &CallSite{
 					Name:       traceLineParts[1],
-					Filename:   traceLineParts[2],
+					Signature:  traceLineParts[2],
+					Filename:   traceLineParts[3],
 					LineNumber: n,
 				}
 				callSites[line] = callSite
 			}
-			currentTrace.Stack = append(currentTrace.Stack, callSite)
+			for i := 0; i < repeats; i++ {
+				currentTrace.Stack = append(currentTrace.Stack, callSite)
+			}
 			continue
 		}
 
 		if inSamples {
-			if strings.HasPrefix(line, " ") {
-				fields := strings.Fields(line)
-				if len(fields) != 6 {
-					parseError("unexpected number of columns")
-				}
-				count, err := strconv.Atoi(fields[3])
-				if err != nil {
-					parseError("cannot parse count")
-				}
-				id, err := strconv.Atoi(fields[4])
-				if err != nil {
-					parseError("cannot parse id")
-				}
-				trace := traces[id]
-				if trace == nil {
-					parseErrorf("found id %d, but no trace with such id exists", id)
-				}
-				trace.Count = count
+			if line == "CPU SAMPLES END" {
+				inSamples = false
+				continue
 			}
-			if samplesColumns.MatchString(line) {
+			// Data rows are identified by their leading rank. Other lines, such as the column header (which
+			// some dumps omit or format differently), are skipped.
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
 				continue
 			}
-			if line == "CPU SAMPLES END" {
-				inSamples = false
+			rank, err := strconv.Atoi(fields[0])
+			if err != nil {
 				continue
 			}
+			if len(fields) != 6 {
+				return nil, parseError("unexpected number of columns")
+			}
+			row := sampleRow{lineNumber: lineNumber, rank: rank}
+			if row.self, err = parsePercent(fields[1]); err != nil {
+				return nil, parseError("cannot parse self percentage")
+			}
+			if row.accum, err = parsePercent(fields[2]); err != nil {
+				return nil, parseError("cannot parse accum percentage")
+			}
+			if row.count, err = strconv.Atoi(fields[3]); err != nil {
+				return nil, parseError("cannot parse count")
+			}
+			if row.id, err = strconv.Atoi(fields[4]); err != nil {
+				return nil, parseError("cannot parse id")
+			}
+			trace := traces[row.id]
+			if trace == nil {
+				unresolved = append(unresolved, row)
+				continue
+			}
+			setSamples(trace, row)
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	for _, row := range unresolved {
+		if trace := traces[row.id]; trace != nil {
+			setSamples(trace, row)
+			continue
+		}
+		lineNumber = row.lineNumber
+		if popts.Strict {
+			return nil, parseErrorf("found id %d, but no trace with such id exists", row.id)
+		}
+		log.Printf("Warning: line %d: ignoring %d samples of trace %d, which is not defined", row.lineNumber,
+			row.count, row.id)
 	}
 
-	traceSet := make(map[*Trace]bool)
+	profile.Traces = make(map[*Trace]bool)
 	for _, trace := range traces {
-		traceSet[trace] = true
+		profile.Traces[trace] = true
+	}
+	return profile, nil
+}
+
+// parsePercent parses a percentage column of the CPU SAMPLES table, such as "12.50%".
+func parsePercent(s string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+}
+
+// parseSamplesHeaderExtra records the optional fields following the total in the CPU SAMPLES header: a
+// timestamp (as in "CPU SAMPLES BEGIN (total = 100) Wed Oct 14 12:00:10 2026") and/or the sampling interval
+// (as in "interval = 10 ms"). Fields that are absent or unrecognized are ignored.
+func parseSamplesHeaderExtra(profile *Profile, extra string) {
+	if m := samplesInterval.FindStringSubmatch(extra); m != nil {
+		if ms, err := strconv.Atoi(m[1]); err == nil {
+			profile.Interval = time.Duration(ms) * time.Millisecond
+		}
+		extra = strings.TrimSpace(samplesInterval.ReplaceAllString(extra, ""))
+	}
+	extra = strings.Trim(extra, " ,;()")
+	if t, err := time.Parse(time.ANSIC, extra); err == nil {
+		profile.Timestamp = t
 	}
-	return traceSet
 }
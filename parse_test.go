@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/cespare/hprofviz/internal/infile"
+)
+
+// parseFile parses the named profile under testdata.
+func parseFile(t *testing.T, name string, popts ParseOptions) *Profile {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := infile.MaybeGunzip(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := ParseProfile(r, popts)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	return profile
+}
+
+// traceCounts returns the sample count of each trace, by ID.
+func traceCounts(traces map[*Trace]bool) map[int]int {
+	counts := make(map[int]int)
+	for trace := range traces {
+		counts[trace.ID] = trace.Count
+	}
+	return counts
+}
+
+func TestParseGzip(t *testing.T) {
+	want := traceCounts(parseFile(t, "sample.txt", ParseOptions{}).Traces)
+	if len(want) != 4 {
+		t.Fatalf("got %d traces in sample.txt; want 4", len(want))
+	}
+	traces, err := ParseHProfFile(filepath.Join("testdata", "sample.txt.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := traceCounts(traces); !reflect.DeepEqual(got, want) {
+		t.Errorf("gzipped profile parsed as %v; want %v", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	const trace1 = "TRACE 300001:\n\tcom.example.Foo.run(Foo.java:10)\n"
+	const samplesBegin = "CPU SAMPLES BEGIN (total = 10) Wed Oct 14 12:00:10 2026\n" +
+		"rank   self  accum   count trace method\n"
+	for _, tt := range []struct {
+		name   string
+		text   string
+		strict bool
+		want   string
+	}{
+		{
+			name: "malformed trace line",
+			text: "TRACE 300001:\n\tcom.example.Foo.run(Foo.java:10)\n\tcom.example.Foo.run\n",
+			want: "Line 3: cannot parse trace line",
+		},
+		{
+			name: "trace line without a file",
+			text: "TRACE 300001:\n\tcom.example.Foo.run(10)\n",
+			want: "Line 2: cannot parse trace line",
+		},
+		{
+			name: "bad line number",
+			text: "TRACE 300001:\n\tcom.example.Foo.run(Foo.java:ten)\n",
+			want: "Line 2: bad line number",
+		},
+		{
+			name: "trace id out of range",
+			text: "TRACE 99999999999999999999:\n\tcom.example.Foo.run(Foo.java:10)\n",
+			want: "Line 1: cannot parse TRACE line",
+		},
+		{
+			name: "duplicate trace",
+			text: trace1 + "TRACE 300002:\n\tcom.example.Foo.go(Foo.java:20)\n" + trace1,
+			want: "Line 5: duplicate trace with id 300001",
+		},
+		{
+			name: "bad count",
+			text: trace1 + samplesBegin + "   1 100.00% 100.00%    ten 300001 com.example.Foo.run\n",
+			want: "Line 5: cannot parse count",
+		},
+		{
+			name: "bad trace id in samples",
+			text: trace1 + samplesBegin + "   1 100.00% 100.00%     10 x300001 com.example.Foo.run\n",
+			want: "Line 5: cannot parse id",
+		},
+		{
+			name: "missing column",
+			text: trace1 + samplesBegin + "   1 100.00% 100.00%     10 300001\n",
+			want: "Line 5: unexpected number of columns",
+		},
+		{
+			name:   "undefined trace with -strict",
+			text:   trace1 + samplesBegin + "   1 100.00% 100.00%     10 300002 com.example.Foo.run\n",
+			strict: true,
+			want:   "Line 5: found id 300002, but no trace with such id exists",
+		},
+	} {
+		_, err := ParseProfile(strings.NewReader(tt.text), ParseOptions{Strict: tt.strict})
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: got error %v; want a *ParseError", tt.name, err)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("%s: got error %q; want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParseReader(t *testing.T) {
+	text, err := os.ReadFile(filepath.Join("testdata", "sample.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	traces, err := ParseHProf(strings.NewReader(string(text)), ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]int{300001: 15, 300002: 50, 300003: 25, 300004: 10}
+	if got := traceCounts(traces); !reflect.DeepEqual(got, want) {
+		t.Errorf("got trace counts %v; want %v", got, want)
+	}
+
+	// An input of - is read from stdin.
+	f, err := os.Open(filepath.Join("testdata", "sample.txt.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+	os.Stdin = f
+	traces, err = ParseHProfFile("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := traceCounts(traces); !reflect.DeepEqual(got, want) {
+		t.Errorf("from stdin: got trace counts %v; want %v", got, want)
+	}
+}
+
+func TestParsePercentages(t *testing.T) {
+	const prefix = "TRACE 300001:\n\tcom.example.Foo.run(Foo.java:10)\n" +
+		"CPU SAMPLES BEGIN (total = 10) Wed Oct 14 12:00:10 2026\n" +
+		"rank   self  accum   count trace method\n"
+	for _, tt := range []struct {
+		row         string
+		self, accum float64
+	}{
+		{"   1 62.50% 100.00%     10 300001 com.example.Foo.run", 62.5, 100},
+		{"   1 62.50 100         10 300001 com.example.Foo.run", 62.5, 100}, // without %
+	} {
+		profile, err := ParseProfile(strings.NewReader(prefix+tt.row+"\n"), ParseOptions{})
+		if err != nil {
+			t.Errorf("%q: %s", tt.row, err)
+			continue
+		}
+		for trace := range profile.Traces {
+			if trace.Rank != 1 || trace.SelfPercent != tt.self || trace.AccumPercent != tt.accum {
+				t.Errorf("%q: got rank %d, self %g%%, accum %g%%; want 1, %g%%, %g%%",
+					tt.row, trace.Rank, trace.SelfPercent, trace.AccumPercent, tt.self, tt.accum)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		row  string
+		want string
+	}{
+		{"   1 62.5x% 100.00%     10 300001 com.example.Foo.run", "Line 5: cannot parse self percentage"},
+		{"   1 62.50% %           10 300001 com.example.Foo.run", "Line 5: cannot parse accum percentage"},
+	} {
+		_, err := ParseProfile(strings.NewReader(prefix+tt.row+"\n"), ParseOptions{})
+		var perr *ParseError
+		if !errors.As(err, &perr) || err.Error() != tt.want {
+			t.Errorf("%q: got error %v; want %q", tt.row, err, tt.want)
+		}
+	}
+}
+
+// syntheticProfile returns a profile with the given number of traces of depth frames each, drawn from a few
+// thousand distinct call sites, and a CPU SAMPLES row for each trace.
+func syntheticProfile(traces, depth int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("JAVA PROFILE 1.0.1, created Wed Oct 14 12:00:00 2026\n\n")
+	for i := 0; i < traces; i++ {
+		fmt.Fprintf(&buf, "TRACE %d:\n", 300000+i)
+		for j := 0; j < depth; j++ {
+			k := (i*7 + j*13) % 5000
+			fmt.Fprintf(&buf, "\tcom.example.C%d.m%d(C%d.java:%d)\n", k/10, k%10, k/10, 10+k%97)
+		}
+	}
+	fmt.Fprintf(&buf, "CPU SAMPLES BEGIN (total = %d) Wed Oct 14 12:00:10 2026\n", traces)
+	buf.WriteString("rank   self  accum   count trace method\n")
+	for i := 0; i < traces; i++ {
+		fmt.Fprintf(&buf, "%d 0.00%% 0.00%% 1 %d com.example.C0.m0\n", i+1, 300000+i)
+	}
+	buf.WriteString("CPU SAMPLES END\n")
+	return buf.Bytes()
+}
+
+func BenchmarkParse(b *testing.B) {
+	// About a million frame occurrences.
+	text := syntheticProfile(100000, 10)
+	b.SetBytes(int64(len(text)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseProfile(bytes.NewReader(text), ParseOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseGeneratedFrames(t *testing.T) {
+	profile := parseFile(t, "generated.txt", ParseOptions{})
+	if got, want := stacks(profile.Traces), []string{
+		"3 a.B.compute:10 a.Main$$Lambda$1/123456.apply:-1 jdk.internal.reflect.GeneratedMethodAccessor12.invoke:-1 " +
+			"com.sun.proxy.$Proxy12.call:-1 a.Main.main:5",
+		"2 a.Main$$Lambda$1/123456.apply:-1 a.Main.main:6",
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got traces %q; want %q", got, want)
+	}
+	opts := testOptions()
+	opts.ExcludeGenerated = regexp.MustCompile(defaultGeneratedFrames)
+	FilterTraces(profile.Traces, opts)
+	// The lambda, accessor, and proxy frames are removed, and the lambda's samples move to its caller.
+	want := []string{"3 a.B.compute:10 a.Main.main:5", "2 a.Main.main:6"}
+	if got := stacks(profile.Traces); !reflect.DeepEqual(got, want) {
+		t.Errorf("with -exclude-generated: got traces %q; want %q", got, want)
+	}
+}
+
+func TestParseBOM(t *testing.T) {
+	want := traceCounts(parseFile(t, "sample.txt", ParseOptions{}).Traces)
+	// bom.txt has the traces of sample.txt, with a UTF-8 byte order mark before the first one.
+	if got := traceCounts(parseFile(t, "bom.txt", ParseOptions{}).Traces); !reflect.DeepEqual(got, want) {
+		t.Errorf("got trace counts %v; want %v, as without the byte order mark", got, want)
+	}
+}
+
+func TestParseSignatures(t *testing.T) {
+	leaves := func(traces map[*Trace]bool) map[string]int {
+		counts := make(map[string]int)
+		for _, node := range CreateNodes(traces, 0) {
+			if node.Count > 0 {
+				counts[fmt.Sprintf("%s%s:%d", node.Name, node.Signature, node.LineNumber)] = node.Count
+			}
+		}
+		return counts
+	}
+	want := map[string]int{"a.B.f(int):10": 3, "a.B.f(int):12": 2, "a.B.f(java.lang.String):20": 1}
+	if got := leaves(parseFile(t, "overload.txt", ParseOptions{}).Traces); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got leaf call sites %v; want %v", got, want)
+	}
+	for _, tt := range []struct {
+		granularity string
+		want        map[string]int
+	}{
+		// The overloads are called from different lines, so stripping their arguments merges nothing.
+		{"line", map[string]int{"a.B.f:10": 3, "a.B.f:12": 2, "a.B.f:20": 1}},
+		{"function", map[string]int{"a.B.f:-1": 6}},
+	} {
+		traces := parseFile(t, "overload.txt", ParseOptions{}).Traces
+		opts := testOptions()
+		opts.StripArgs = true
+		opts.Granularity = tt.granularity
+		FilterTraces(traces, opts)
+		if got := leaves(traces); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("with -strip-args -granularity %s: got leaf call sites %v; want %v",
+				tt.granularity, got, tt.want)
+		}
+	}
+}
+
+func TestParseExpandRepeats(t *testing.T) {
+	const samples = "CPU SAMPLES BEGIN (total = 4) Wed Oct 14 12:00:10 2026\n" +
+		"rank   self  accum   count trace method\n" +
+		"   1 100.00% 100.00%       4 1 a.B.rec\n" +
+		"CPU SAMPLES END\n"
+	for _, tt := range []struct {
+		name   string
+		frame  string // the leaf frame of the trace, called by a.Main.main
+		expand bool
+		want   string // the stack, or the error
+	}{
+		{"repeated frame", "a.B.rec(B.java:10) x3", true, "4 a.B.rec:10 a.B.rec:10 a.B.rec:10 a.Main.main:5"},
+		{"single repeat", "a.B.rec(B.java:10) x1", true, "4 a.B.rec:10 a.Main.main:5"},
+		{"no repeats", "a.B.rec(B.java:10) x0", true, "Line 2: bad frame repeat count"},
+		{"without -expand-repeats", "a.B.rec(B.java:10) x3", false, "Line 2: cannot parse trace line"},
+	} {
+		text := "TRACE 1:\n\t" + tt.frame + "\n\ta.Main.main(Main.java:5)\n" + samples
+		var got string
+		profile, err := ParseProfile(strings.NewReader(text), ParseOptions{ExpandRepeats: tt.expand})
+		if err != nil {
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Errorf("%s: got error %v; want a *ParseError", tt.name, err)
+				continue
+			}
+			got = err.Error()
+		} else {
+			got = strings.Join(stacks(profile.Traces), ", ")
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseNoColumnHeader(t *testing.T) {
+	const traces = "TRACE 1:\n\ta.B.f(B.java:10)\nTRACE 2:\n\ta.B.g(B.java:20)\n" +
+		"CPU SAMPLES BEGIN (total = 8) Wed Oct 14 12:00:10 2026\n"
+	for _, tt := range []struct {
+		name string
+		rows string // the lines between CPU SAMPLES BEGIN and END
+	}{
+		{"column header", "rank   self  accum   count trace method\n" +
+			"   1 62.50% 62.50%       5 1 a.B.f\n   2 37.50% 100.00%      3 2 a.B.g\n"},
+		{"no column header", "   1 62.50% 62.50%       5 1 a.B.f\n   2 37.50% 100.00%      3 2 a.B.g\n"},
+		{"tab-indented rows", "\t1 62.50% 62.50%       5 1 a.B.f\n\t2 37.50% 100.00%      3 2 a.B.g\n"},
+		{"other column header", "RANK SELF ACCUM COUNT TRACE METHOD\n\n" +
+			"   1 62.50% 62.50%       5 1 a.B.f\n   2 37.50% 100.00%      3 2 a.B.g\n"},
+	} {
+		profile, err := ParseProfile(strings.NewReader(traces+tt.rows+"CPU SAMPLES END\n"), ParseOptions{})
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got, want := traceCounts(profile.Traces), map[int]int{1: 5, 2: 3}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got trace counts %v; want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestParseSamplesBeforeTraces(t *testing.T) {
+	const (
+		trace1  = "TRACE 1:\n\ta.B.f(B.java:10)\n"
+		trace2  = "TRACE 2:\n\ta.B.g(B.java:20)\n"
+		samples = "CPU SAMPLES BEGIN (total = 9) Wed Oct 14 12:00:10 2026\n" +
+			"rank   self  accum   count trace method\n" +
+			"   1 55.56% 55.56%       5 1 a.B.f\n" +
+			"   2 33.33% 88.89%       3 2 a.B.g\n"
+		undefined = "   3 11.11% 100.00%      1 9 x.Y.z\n"
+		end       = "CPU SAMPLES END\n"
+	)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	for _, tt := range []struct {
+		name    string
+		text    string
+		strict  bool
+		want    string // the error, if any
+		warning string
+	}{
+		{name: "samples first", text: samples + end + trace1 + trace2},
+		{name: "samples between traces", text: trace1 + samples + end + trace2},
+		{
+			name:    "undefined trace",
+			text:    samples + undefined + end + trace1 + trace2,
+			warning: "Warning: line 5: ignoring 1 samples of trace 9, which is not defined",
+		},
+		{
+			name:   "undefined trace with -strict",
+			text:   samples + undefined + end + trace1 + trace2,
+			strict: true,
+			want:   "Line 5: found id 9, but no trace with such id exists",
+		},
+	} {
+		logged.Reset()
+		profile, err := ParseProfile(strings.NewReader(tt.text), ParseOptions{Strict: tt.strict})
+		if tt.want != "" {
+			var perr *ParseError
+			if !errors.As(err, &perr) || err.Error() != tt.want {
+				t.Errorf("%s: got error %v; want %q", tt.name, err, tt.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got, want := traceCounts(profile.Traces), map[int]int{1: 5, 2: 3}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got trace counts %v; want %v", tt.name, got, want)
+		}
+		if got := logged.String(); !strings.Contains(got, tt.warning) || tt.warning == "" && got != "" {
+			t.Errorf("%s: logged %q; want %q", tt.name, got, tt.warning)
+		}
+	}
+}
+
+func TestParseThreads(t *testing.T) {
+	const samples = "CPU SAMPLES BEGIN (total = 9) Wed Oct 14 12:00:10 2026\n" +
+		"rank   self  accum   count trace method\n" +
+		"   1 55.56% 55.56%       5 1 a.B.f\n" +
+		"   2 33.33% 88.89%       3 2 a.B.g\n" +
+		"   3 11.11% 100.00%      1 3 a.B.h\n" +
+		"CPU SAMPLES END\n"
+	for _, tt := range []struct {
+		name         string
+		text         string
+		threads      map[int]Thread
+		traceThreads map[int]int // by trace ID
+		groups       string      // from PartitionByThread
+	}{
+		{
+			// Trace 3 was sampled in a thread without a THREAD START record.
+			name: "thread=y",
+			text: "THREAD START (obj=50000190, id = 1, name=\"main\", group=\"main\")\n" +
+				"THREAD START (obj=50000191, id = 2, name=\"pool-1 worker\", group=\"main\")\n" +
+				"TRACE 1: (thread=1)\n\ta.B.f(B.java:10)\n" +
+				"TRACE 2: (thread=2)\n\ta.B.g(B.java:20)\n" +
+				"TRACE 3: (thread=3)\n\ta.B.h(B.java:30)\n" +
+				"THREAD END (id = 2)\n" + samples,
+			threads: map[int]Thread{
+				1: {Serial: 1, Name: "main", Group: "main"},
+				2: {Serial: 2, Name: "pool-1 worker", Group: "main", Ended: true},
+			},
+			traceThreads: map[int]int{1: 1, 2: 2, 3: 3},
+			groups:       "thread-1:5 thread-2:3 thread-3:1",
+		},
+		{
+			name: "no thread records",
+			text: "TRACE 1:\n\ta.B.f(B.java:10)\nTRACE 2:\n\ta.B.g(B.java:20)\nTRACE 3:\n\ta.B.h(B.java:30)\n" +
+				samples,
+			threads:      map[int]Thread{},
+			traceThreads: map[int]int{1: 0, 2: 0, 3: 0},
+			groups:       "thread-0:9",
+		},
+		{
+			name: "THREAD END without START",
+			text: "TRACE 1:\n\ta.B.f(B.java:10)\nTRACE 2:\n\ta.B.g(B.java:20)\nTRACE 3:\n\ta.B.h(B.java:30)\n" +
+				"THREAD END (id = 2)\n" + samples,
+			threads:      map[int]Thread{},
+			traceThreads: map[int]int{1: 0, 2: 0, 3: 0},
+			groups:       "thread-0:9",
+		},
+	} {
+		profile, err := ParseProfile(strings.NewReader(tt.text), ParseOptions{})
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		threads := make(map[int]Thread)
+		for serial, thread := range profile.Threads {
+			threads[serial] = *thread
+		}
+		if !reflect.DeepEqual(threads, tt.threads) {
+			t.Errorf("%s: got threads %+v; want %+v", tt.name, threads, tt.threads)
+		}
+		traceThreads := make(map[int]int)
+		for trace := range profile.Traces {
+			traceThreads[trace.ID] = trace.Thread
+		}
+		if !reflect.DeepEqual(traceThreads, tt.traceThreads) {
+			t.Errorf("%s: got trace threads %v; want %v", tt.name, traceThreads, tt.traceThreads)
+		}
+		var groups []string
+		for _, g := range PartitionByThread(profile.Traces, 0) {
+			groups = append(groups, fmt.Sprintf("%s:%d", g.Name, CountSum(g.Traces)))
+		}
+		if got := strings.Join(groups, " "); got != tt.groups {
+			t.Errorf("%s: got thread groups %s; want %s", tt.name, got, tt.groups)
+		}
+	}
+}
+
+func TestParseNativeFrames(t *testing.T) {
+	const samples = "CPU SAMPLES BEGIN (total = 8) Wed Oct 14 12:00:10 2026\n" +
+		"rank   self  accum   count trace method\n" +
+		"   1 62.50% 62.50%       5 1 java.lang.Object.wait\n" +
+		"   2 37.50% 100.00%      3 2 a.B.g\n" +
+		"CPU SAMPLES END\n"
+	for _, tt := range []struct {
+		location string // of the leaf frame of trace 1
+		native   bool
+		want     []string // the stacks with -keep-native=false
+	}{
+		// The native leaf's samples move to its caller.
+		{"Native method", true, []string{"5 a.Main.run:10", "3 a.B.g:20 a.Main.run:11"}},
+		{"Compiled method", true, []string{"5 a.Main.run:10", "3 a.B.g:20 a.Main.run:11"}},
+		{"Unknown line", false, []string{"5 java.lang.Object.wait:-1 a.Main.run:10", "3 a.B.g:20 a.Main.run:11"}},
+		{"502", false, []string{"5 java.lang.Object.wait:502 a.Main.run:10", "3 a.B.g:20 a.Main.run:11"}},
+	} {
+		text := "TRACE 1:\n\tjava.lang.Object.wait(Object.java:" + tt.location + ")\n\ta.Main.run(Main.java:10)\n" +
+			"TRACE 2:\n\ta.B.g(B.java:20)\n\ta.Main.run(Main.java:11)\n" + samples
+		profile, err := ParseProfile(strings.NewReader(text), ParseOptions{})
+		if err != nil {
+			t.Errorf("%s: %s", tt.location, err)
+			continue
+		}
+		for trace := range profile.Traces {
+			if leaf := trace.Stack[0]; trace.ID == 1 && isNative(leaf) != tt.native {
+				t.Errorf("%s: got leaf %s with isNative %t; want %t", tt.location, leaf, isNative(leaf), tt.native)
+			}
+		}
+		opts := testOptions()
+		opts.KeepNative = false
+		FilterTraces(profile.Traces, opts)
+		if got := stacks(profile.Traces); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: with -keep-native=false, got traces %q; want %q", tt.location, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// WritePprof writes traces to w as an (uncompressed) pprof profile, in the profile.proto format read by
+// go tool pprof. Each trace is a sample whose value is the trace's sample count, each distinct call site is a
+// location with a single line, and each distinct method (by name, signature, and file) is a function. Call sites
+// without a line number (unknown, native, or compiled) are given line 0.
+//
+// The protobuf encoding is written by hand, as only a handful of message types are needed.
+func WritePprof(w io.Writer, traces map[*Trace]bool) error {
+	p := newPprofWriter()
+	// Write samples in a deterministic order.
+	sorted := make([]*Trace, 0, len(traces))
+	for trace := range traces {
+		sorted = append(sorted, trace)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Seq < sorted[j].Seq })
+
+	var profile, sampleType pprofMessage
+	sampleType.intField(1, p.str("samples"))
+	sampleType.intField(2, p.str("count"))
+	profile.bytesField(1, sampleType.Bytes())
+	for _, trace := range sorted {
+		var sample, ids, values pprofMessage
+		// Like Trace.Stack, the locations of a sample are leaf first.
+		for _, site := range trace.Stack {
+			ids.varint(p.location(site))
+		}
+		sample.bytesField(1, ids.Bytes())
+		values.varint(uint64(trace.Count))
+		sample.bytesField(2, values.Bytes())
+		profile.bytesField(2, sample.Bytes())
+	}
+	for _, loc := range p.locations {
+		profile.bytesField(4, loc)
+	}
+	for _, fn := range p.functions {
+		profile.bytesField(5, fn)
+	}
+	for _, s := range p.strings {
+		profile.bytesField(6, []byte(s))
+	}
+	_, err := w.Write(profile.Bytes())
+	return err
+}
+
+// A pprofMessage is an encoded protobuf message under construction.
+type pprofMessage struct {
+	bytes.Buffer
+}
+
+// varint writes v as a bare varint, as in a packed repeated field.
+func (m *pprofMessage) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	m.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+// intField writes the varint field (such as an int64 or uint64) with the given field number.
+func (m *pprofMessage) intField(field int, v int64) {
+	m.varint(uint64(field) << 3)
+	m.varint(uint64(v))
+}
+
+// bytesField writes the length-delimited field (a string, packed repeated field, or encoded message) with the
+// given field number.
+func (m *pprofMessage) bytesField(field int, b []byte) {
+	m.varint(uint64(field)<<3 | 2)
+	m.varint(uint64(len(b)))
+	m.Write(b)
+}
+
+// A pprofWriter accumulates the string table, functions, and locations of a profile.
+type pprofWriter struct {
+	strings     []string
+	stringIndex map[string]int64
+
+	functions  [][]byte // encoded Function messages
+	functionID map[pprofFunction]uint64
+
+	locations  [][]byte // encoded Location messages
+	locationID map[pprofLocation]uint64
+}
+
+type pprofFunction struct {
+	name, filename string
+}
+
+type pprofLocation struct {
+	function uint64
+	line     int
+}
+
+func newPprofWriter() *pprofWriter {
+	return &pprofWriter{
+		// The first string of the table must be empty.
+		strings:     []string{""},
+		stringIndex: map[string]int64{"": 0},
+		functionID:  make(map[pprofFunction]uint64),
+		locationID:  make(map[pprofLocation]uint64),
+	}
+}
+
+// str returns the index of s in the string table, adding it if needed.
+func (p *pprofWriter) str(s string) int64 {
+	if i, ok := p.stringIndex[s]; ok {
+		return i
+	}
+	i := int64(len(p.strings))
+	p.strings = append(p.strings, s)
+	p.stringIndex[s] = i
+	return i
+}
+
+// function returns the ID of the function of site, adding it if needed. IDs start at 1.
+func (p *pprofWriter) function(site *CallSite) uint64 {
+	key := pprofFunction{site.Name + site.Signature, site.Filename}
+	if id, ok := p.functionID[key]; ok {
+		return id
+	}
+	id := uint64(len(p.functions) + 1)
+	var fn pprofMessage
+	fn.intField(1, int64(id))
+	fn.intField(2, p.str(key.name))
+	fn.intField(3, p.str(key.name))
+	fn.intField(4, p.str(key.filename))
+	p.functions = append(p.functions, fn.Bytes())
+	p.functionID[key] = id
+	return id
+}
+
+// location returns the ID of the location of site, adding it if needed. IDs start at 1.
+func (p *pprofWriter) location(site *CallSite) uint64 {
+	key := pprofLocation{p.function(site), site.LineNumber}
+	if key.line < 0 {
+		key.line = 0
+	}
+	if id, ok := p.locationID[key]; ok {
+		return id
+	}
+	id := uint64(len(p.locations) + 1)
+	var line, loc pprofMessage
+	line.intField(1, int64(key.function))
+	line.intField(2, int64(key.line))
+	loc.intField(1, int64(id))
+	loc.bytesField(4, line.Bytes())
+	p.locations = append(p.locations, loc.Bytes())
+	p.locationID[key] = id
+	return id
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A protoField is a field of an encoded protobuf message: a varint or a length-delimited value.
+type protoField struct {
+	num   int
+	value uint64 // for varints
+	bytes []byte // for length-delimited fields
+}
+
+// decodeProto splits the encoded message b into its fields. It only handles the wire types WritePprof uses.
+func decodeProto(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad field key in % x", b)
+		}
+		b = b[n:]
+		f := protoField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			if f.value, n = binary.Uvarint(b); n <= 0 {
+				t.Fatalf("bad varint for field %d", f.num)
+			}
+			b = b[n:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				t.Fatalf("bad length for field %d", f.num)
+			}
+			f.bytes = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d for field %d", key&7, f.num)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// decodeVarints decodes a packed repeated varint field.
+func decodeVarints(t *testing.T, b []byte) []uint64 {
+	t.Helper()
+	var vs []uint64
+	for len(b) > 0 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("bad packed varint in % x", b)
+		}
+		vs = append(vs, v)
+		b = b[n:]
+	}
+	return vs
+}
+
+func TestWritePprof(t *testing.T) {
+	traces := testTraces("5 c b:3 a", "3 b:4 a", "2 [unknown]:-1 a")
+	for trace := range traces {
+		for _, site := range trace.Stack {
+			if site.Name == "b" {
+				site.Signature = "(I)V"
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := WritePprof(&buf, traces); err != nil {
+		t.Fatal(err)
+	}
+
+	// Decode the Profile message: sample types (1), samples (2), locations (4), functions (5), and the string
+	// table (6).
+	var strs []string
+	var sampleTypes, samples [][]byte
+	functions := make(map[uint64]string)    // by ID: "name file"
+	locations := make(map[uint64][2]uint64) // by ID: function ID and line
+	var locationFields, functionFields [][]byte
+	for _, f := range decodeProto(t, buf.Bytes()) {
+		switch f.num {
+		case 1:
+			sampleTypes = append(sampleTypes, f.bytes)
+		case 2:
+			samples = append(samples, f.bytes)
+		case 4:
+			locationFields = append(locationFields, f.bytes)
+		case 5:
+			functionFields = append(functionFields, f.bytes)
+		case 6:
+			strs = append(strs, string(f.bytes))
+		default:
+			t.Errorf("unexpected Profile field %d", f.num)
+		}
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("the string table %q doesn't start with the empty string", strs)
+	}
+	str := func(i uint64) string {
+		if i >= uint64(len(strs)) {
+			t.Fatalf("string index %d is out of range", i)
+		}
+		return strs[i]
+	}
+	if len(sampleTypes) != 1 {
+		t.Fatalf("got %d sample types; want 1", len(sampleTypes))
+	}
+	var sampleType []string
+	for _, f := range decodeProto(t, sampleTypes[0]) {
+		sampleType = append(sampleType, str(f.value))
+	}
+	if want := []string{"samples", "count"}; !reflect.DeepEqual(sampleType, want) {
+		t.Errorf("got sample type %q; want %q", sampleType, want)
+	}
+	for _, b := range functionFields {
+		var id uint64
+		var name, systemName, filename string
+		for _, f := range decodeProto(t, b) {
+			switch f.num {
+			case 1:
+				id = f.value
+			case 2:
+				name = str(f.value)
+			case 3:
+				systemName = str(f.value)
+			case 4:
+				filename = str(f.value)
+			}
+		}
+		if name != systemName {
+			t.Errorf("function %d has name %q but system name %q", id, name, systemName)
+		}
+		functions[id] = name + " " + filename
+	}
+	for _, b := range locationFields {
+		var id uint64
+		var line [2]uint64
+		for _, f := range decodeProto(t, b) {
+			switch f.num {
+			case 1:
+				id = f.value
+			case 4:
+				for _, lf := range decodeProto(t, f.bytes) {
+					line[lf.num-1] = lf.value
+				}
+			}
+		}
+		locations[id] = line
+	}
+
+	var got []string
+	for _, b := range samples {
+		var stack []string
+		var values []uint64
+		for _, f := range decodeProto(t, b) {
+			switch f.num {
+			case 1:
+				for _, id := range decodeVarints(t, f.bytes) {
+					loc, ok := locations[id]
+					if !ok {
+						t.Fatalf("sample refers to missing location %d", id)
+					}
+					fn, ok := functions[loc[0]]
+					if !ok {
+						t.Fatalf("location %d refers to missing function %d", id, loc[0])
+					}
+					stack = append(stack, fmt.Sprintf("%s:%d", fn, loc[1]))
+				}
+			case 2:
+				values = decodeVarints(t, f.bytes)
+			}
+		}
+		got = append(got, fmt.Sprint(values, " ", strings.Join(stack, ", ")))
+	}
+	want := []string{
+		"[5] c c.java:1, b(I)V b.java:3, a a.java:1",
+		"[3] b(I)V b.java:4, a a.java:1",
+		"[2] [unknown] [unknown].java:0, a a.java:1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if len(functions) != 4 || len(locations) != 5 {
+		t.Errorf("got %d functions and %d locations; want 4 and 5, shared between samples", len(functions), len(locations))
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A ThreadGroup is the set of traces sampled in one thread, or in several lumped-together threads.
+type ThreadGroup struct {
+	Name    string // used in output filenames
+	Threads []int  // thread serials
+	Traces  map[*Trace]bool
+}
+
+// PartitionByThread splits traces by the thread they were sampled in, ordered by descending sample count
+// (then by thread serial). If topN is positive, only the topN busiest threads get their own group, and the
+// rest are lumped together in a final "other-threads" group.
+func PartitionByThread(traces map[*Trace]bool, topN int) []*ThreadGroup {
+	byThread := make(map[int]*ThreadGroup)
+	var groups []*ThreadGroup
+	for trace := range traces {
+		g, ok := byThread[trace.Thread]
+		if !ok {
+			g = &ThreadGroup{
+				Name:    fmt.Sprintf("thread-%d", trace.Thread),
+				Threads: []int{trace.Thread},
+				Traces:  make(map[*Trace]bool),
+			}
+			byThread[trace.Thread] = g
+			groups = append(groups, g)
+		}
+		g.Traces[trace] = true
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		c1, c2 := CountSum(groups[i].Traces), CountSum(groups[j].Traces)
+		if c1 != c2 {
+			return c1 > c2
+		}
+		return groups[i].Threads[0] < groups[j].Threads[0]
+	})
+	if topN <= 0 || len(groups) <= topN {
+		return groups
+	}
+	other := &ThreadGroup{Name: "other-threads", Traces: make(map[*Trace]bool)}
+	for _, g := range groups[topN:] {
+		other.Threads = append(other.Threads, g.Threads...)
+		for trace := range g.Traces {
+			other.Traces[trace] = true
+		}
+	}
+	return append(groups[:topN], other)
+}
+
+// threadOutputName inserts the group name before the extension of output (so that "out.dot" becomes
+// "out.thread-200001.dot", and "out.dot.gz" becomes "out.thread-200001.dot.gz").
+func threadOutputName(output string, g *ThreadGroup) string {
+	gz := ""
+	if strings.HasSuffix(output, ".gz") {
+		output, gz = strings.TrimSuffix(output, ".gz"), ".gz"
+	}
+	ext := filepath.Ext(output)
+	return strings.TrimSuffix(output, ext) + "." + g.Name + ext + gz
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// A TreeNode is a node in a calling-context tree: each distinct path from a root frame is its own TreeNode.
+//
+// The call graph built by CreateNodes is a DAG (a CallSite reached via several callers is a single Node), so
+// it cannot be nested directly. Instead the tree is built from the traces themselves by merging common
+// prefixes of their stacks (root first). A CallSite reached via different paths therefore appears once per
+// distinct path, with its counts split accordingly.
+type TreeNode struct {
+	Name       string      `json:"name"`
+	Signature  string      `json:"signature,omitempty"`
+	Filename   string      `json:"filename,omitempty"`
+	LineNumber int         `json:"line,omitempty"`
+	Self       int         `json:"self"`
+	Cumulative int         `json:"cumulative"`
+	Children   []*TreeNode `json:"children,omitempty"`
+
+	childBySite map[*CallSite]*TreeNode
+}
+
+// BuildTree merges the stacks of traces into a tree rooted at a synthetic "root" node.
+func BuildTree(traces map[*Trace]bool) *TreeNode {
+	root := &TreeNode{Name: "root"}
+	for trace := range traces {
+		root.Cumulative += trace.Count
+		parent := root
+		for i := len(trace.Stack) - 1; i >= 0; i-- {
+			site := trace.Stack[i]
+			node, ok := parent.childBySite[site]
+			if !ok {
+				node = &TreeNode{
+					Name:       site.Name,
+					Signature:  site.Signature,
+					Filename:   site.Filename,
+					LineNumber: site.LineNumber,
+				}
+				if parent.childBySite == nil {
+					parent.childBySite = make(map[*CallSite]*TreeNode)
+				}
+				parent.childBySite[site] = node
+				parent.Children = append(parent.Children, node)
+			}
+			node.Cumulative += trace.Count
+			if i == 0 {
+				node.Self += trace.Count
+			}
+			parent = node
+		}
+	}
+	root.sortChildren()
+	return root
+}
+
+// sortChildren orders children by descending cumulative count (then by name) so output is deterministic.
+func (t *TreeNode) sortChildren() {
+	sort.Slice(t.Children, func(i, j int) bool {
+		c1, c2 := t.Children[i], t.Children[j]
+		if c1.Cumulative != c2.Cumulative {
+			return c1.Cumulative > c2.Cumulative
+		}
+		if c1.Name != c2.Name {
+			return c1.Name < c2.Name
+		}
+		return c1.LineNumber < c2.LineNumber
+	})
+	for _, child := range t.Children {
+		child.sortChildren()
+	}
+}
+
+// PruneTree removes all subtrees whose cumulative count is at most t times the root's count.
+func PruneTree(root *TreeNode, t float64) {
+	min := int(t * float64(root.Cumulative))
+	var prune func(node *TreeNode)
+	prune = func(node *TreeNode) {
+		var kept []*TreeNode
+		for _, child := range node.Children {
+			if child.Cumulative > min {
+				prune(child)
+				kept = append(kept, child)
+			}
+		}
+		node.Children = kept
+	}
+	prune(root)
+}
+
+// WriteTreemapJSON writes the tree as nested JSON objects suitable for D3's hierarchy layouts.
+func WriteTreemapJSON(w io.Writer, root *TreeNode) error {
+	return json.NewEncoder(w).Encode(root)
+}
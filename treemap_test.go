@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWriteTreemapJSON(t *testing.T) {
+	traces := sampleTraces(t)
+	opts := testOptions()
+	opts.Format = "treemap-json"
+	var buf strings.Builder
+	if err := WriteOutput(&buf, traces, opts); err != nil {
+		t.Fatal(err)
+	}
+	var root TreeNode
+	if err := json.Unmarshal([]byte(buf.String()), &root); err != nil {
+		t.Fatalf("the output is not valid JSON: %s\n%s", err, buf.String())
+	}
+	var count func(node *TreeNode) int
+	count = func(node *TreeNode) int {
+		n := 1
+		for _, child := range node.Children {
+			n += count(child)
+		}
+		return n
+	}
+	if n := count(&root); n != 10 {
+		t.Errorf("got %d tree nodes; want 10", n)
+	}
+	if root.Name != "root" || root.Cumulative != 100 || len(root.Children) != 1 {
+		t.Fatalf("got root %s (%d) with %d children; want root (100) with 1 child",
+			root.Name, root.Cumulative, len(root.Children))
+	}
+	mainNode := root.Children[0]
+	if mainNode.Name != "com.example.Main.main" || len(mainNode.Children) != 4 {
+		t.Fatalf("got %s with %d children; want com.example.Main.main with 4", mainNode.Name, len(mainNode.Children))
+	}
+	// Foo.run:11, the heaviest child of main, calls the renamed Bar.compute.
+	hot := mainNode.Children[0]
+	if hot.Name != "com.example.Foo.run" || hot.LineNumber != 11 || len(hot.Children) != 1 {
+		t.Fatalf("got %s:%d with %d children; want com.example.Foo.run:11 with 1",
+			hot.Name, hot.LineNumber, len(hot.Children))
+	}
+	if leaf := hot.Children[0]; leaf.Name != trickyName || leaf.Self != 50 {
+		t.Errorf("got leaf %q (self %d); want %q (self 50)", leaf.Name, leaf.Self, trickyName)
+	}
+	if strings.ContainsAny(buf.String(), "<>&") {
+		t.Error("the output has unescaped HTML characters")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// A stackCheck is a test for a suspicious stack, as may result from a corrupt dump or a parser bug.
+type stackCheck struct {
+	name  string
+	check func(t *Trace) (problem string, ok bool) // ok is false if the trace is suspicious
+}
+
+// threadEntryFrames matches the names of methods that a thread starts in, which should only appear as the
+// root frame of a stack.
+var threadEntryFrames = regexp.MustCompile(`^java\.lang\.Thread\.(run|exit)$`)
+
+// threadInnerFrames matches the names of methods that thread entry methods call, which should never be the root
+// frame of a stack. (On newer JDKs, Thread.run calls the Runnable through Thread.runWith.)
+var threadInnerFrames = regexp.MustCompile(`^java\.lang\.Thread\.runWith$`)
+
+// maxFrameRuns is the number of separate runs of the same frame in a stack above which it is suspicious.
+// (Direct recursion is one run; mutual recursion gives several, but seldom this many.)
+const maxFrameRuns = 8
+
+// stackChecks are the checks run by -validate-stacks. To check for another suspicious pattern, add it here.
+var stackChecks = []stackCheck{
+	{"empty stack", func(t *Trace) (string, bool) {
+		if len(t.Stack) == 0 && t.Count > 0 {
+			return fmt.Sprintf("%d samples but no frames", t.Count), false
+		}
+		return "", true
+	}},
+	{"thread entry below the root", func(t *Trace) (string, bool) {
+		for i := 0; i+1 < len(t.Stack); i++ {
+			site := t.Stack[i]
+			if threadEntryFrames.MatchString(site.Name) {
+				return fmt.Sprintf("thread entry method %s is frame %d of %d rather than the root",
+					site.Name, i+1, len(t.Stack)), false
+			}
+		}
+		return "", true
+	}},
+	{"truncated thread entry", func(t *Trace) (string, bool) {
+		if len(t.Stack) == 0 {
+			return "", true
+		}
+		if root := t.Stack[len(t.Stack)-1]; threadInnerFrames.MatchString(root.Name) {
+			return fmt.Sprintf("root frame %s is never a thread's outermost frame", root.Name), false
+		}
+		return "", true
+	}},
+	{"scattered frame", func(t *Trace) (string, bool) {
+		runs := make(map[*CallSite]int)
+		for i, site := range t.Stack {
+			if i == 0 || t.Stack[i-1] != site {
+				runs[site]++
+			}
+		}
+		for _, site := range t.Stack {
+			if runs[site] > maxFrameRuns {
+				return fmt.Sprintf("%s appears in %d separate places", site, runs[site]), false
+			}
+		}
+		return "", true
+	}},
+}
+
+// ValidateStacks runs stackChecks on traces and returns a description of each problem found, ordered by
+// trace.
+func ValidateStacks(traces map[*Trace]bool) []string {
+	var problems []string
+	for _, trace := range SortedTraces(traces) {
+		for _, c := range stackChecks {
+			if problem, ok := c.check(trace); !ok {
+				problems = append(problems, fmt.Sprintf("trace %d: %s: %s", trace.ID, c.name, problem))
+			}
+		}
+	}
+	return problems
+}
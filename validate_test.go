@@ -0,0 +1,22 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateStacks(t *testing.T) {
+	traces := testTraces(
+		"5 compute java.lang.Thread.runWith java.lang.Thread.run",
+		"4 compute java.lang.Thread.runWith",
+		"3 compute java.lang.Thread.run serve",
+		"2 cleanup java.lang.Thread.exit",
+	)
+	want := []string{
+		"trace 2: truncated thread entry: root frame java.lang.Thread.runWith is never a thread's outermost frame",
+		"trace 3: thread entry below the root: thread entry method java.lang.Thread.run is frame 2 of 3 rather than the root",
+	}
+	if got := ValidateStacks(traces); !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems %q; want %q", got, want)
+	}
+}